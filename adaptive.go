@@ -0,0 +1,138 @@
+package sturdyc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// adaptiveLatencyWeight is the weight that the latest observation is given
+	// in the moving averages of the batch refresh latency and error rate.
+	adaptiveLatencyWeight = 0.2
+	// adaptiveMaxErrorRate is the error rate at which we'll start to back off.
+	adaptiveMaxErrorRate = 0.1
+)
+
+// adaptiveBounds holds the limits that an adaptive refresh buffer is allowed to move within.
+type adaptiveBounds struct {
+	minBatchSize  int
+	maxBatchSize  int
+	minBufferTime time.Duration
+	maxBufferTime time.Duration
+	targetLatency time.Duration
+}
+
+// adaptiveBuffer holds the current batch size and buffer time for a batch
+// group, along with the moving averages that are used to adjust them.
+type adaptiveBuffer struct {
+	batchSize    int
+	bufferTime   time.Duration
+	latency      time.Duration
+	errorRate    float64
+	lastObserved time.Time
+}
+
+// adaptiveBuffers keeps track of the adaptive refresh buffers for each batch group.
+type adaptiveBuffers struct {
+	mu      sync.Mutex
+	buffers map[string]*adaptiveBuffer
+}
+
+func newAdaptiveBuffers() *adaptiveBuffers {
+	return &adaptiveBuffers{
+		mu:      sync.Mutex{},
+		buffers: make(map[string]*adaptiveBuffer),
+	}
+}
+
+// getOrCreate should be called WITH a lock. New buffers start in the middle
+// of their bounds. Whenever a new group is added, we'll take the opportunity
+// to remove the groups that haven't been refreshed within the last TTL.
+func (a *adaptiveBuffers) getOrCreate(
+	group string,
+	bounds adaptiveBounds,
+	now time.Time,
+	ttl time.Duration,
+) *adaptiveBuffer {
+	if buffer, ok := a.buffers[group]; ok {
+		return buffer
+	}
+
+	for g, buffer := range a.buffers {
+		if now.Sub(buffer.lastObserved) > ttl {
+			delete(a.buffers, g)
+		}
+	}
+
+	buffer := &adaptiveBuffer{
+		batchSize:    (bounds.minBatchSize + bounds.maxBatchSize) / 2,
+		bufferTime:   (bounds.minBufferTime + bounds.maxBufferTime) / 2,
+		latency:      0,
+		errorRate:    0,
+		lastObserved: now,
+	}
+	a.buffers[group] = buffer
+	return buffer
+}
+
+// config returns the current buffering settings for the batch group.
+func (a *adaptiveBuffers) config(group string, bounds adaptiveBounds, now time.Time, ttl time.Duration) bufferConfig {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	buffer := a.getOrCreate(group, bounds, now, ttl)
+	return bufferConfig{
+		enabled:       true,
+		maxBufferSize: buffer.batchSize,
+		bufferTimeout: buffer.bufferTime,
+		adaptive:      nil,
+	}
+}
+
+// observe records the outcome of a batch refresh. As long as the upstream
+// keeps up, we'll send larger batches and wait less for them to fill up. If
+// it becomes slow or starts to fail, we'll back off by sending smaller
+// batches less often.
+func (a *adaptiveBuffers) observe(
+	group string,
+	bounds adaptiveBounds,
+	latency time.Duration,
+	failed bool,
+	now time.Time,
+	ttl time.Duration,
+) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buffer := a.getOrCreate(group, bounds, now, ttl)
+	buffer.lastObserved = now
+	buffer.latency += time.Duration(adaptiveLatencyWeight * float64(latency-buffer.latency))
+	var failure float64
+	if failed {
+		failure = 1
+	}
+	buffer.errorRate += adaptiveLatencyWeight * (failure - buffer.errorRate)
+
+	if failed || buffer.latency > bounds.targetLatency || buffer.errorRate > adaptiveMaxErrorRate {
+		buffer.batchSize = max(bounds.minBatchSize, buffer.batchSize/2)
+		buffer.bufferTime = min(bounds.maxBufferTime, buffer.bufferTime*3/2)
+		return
+	}
+
+	buffer.batchSize = min(bounds.maxBatchSize, buffer.batchSize+max(1, buffer.batchSize/10))
+	buffer.bufferTime = max(bounds.minBufferTime, buffer.bufferTime*9/10)
+}
+
+// observeBatchRefresh records the outcome of a batch refresh if adaptive
+// refresh buffering has been enabled for the key function's batch group.
+func (c *Client) observeBatchRefresh(keyFn KeyFunc, latency time.Duration, err error) {
+	groupKeyFn, ok := keyFn.(GroupKeyFunc)
+	if !ok {
+		return
+	}
+	group := groupKeyFn.Group()
+	cfg := c.baseBufferConfig(group)
+	if !cfg.enabled || cfg.adaptive == nil {
+		return
+	}
+	c.adaptiveBuffers.observe(group, *cfg.adaptive, latency, err != nil, c.clock.Now(), c.ttl)
+}
@@ -0,0 +1,115 @@
+package sturdyc
+
+import "context"
+
+// BatchIDFetchFn is a BatchFetchFn for records with IDs that aren't strings.
+type BatchIDFetchFn[ID comparable, T any] func(ctx context.Context, ids []ID) (map[ID]T, error)
+
+// IDFn turns an ID into the string that is passed to the KeyFunc. Two IDs
+// should only produce the same string if they're equal.
+type IDFn[ID comparable] func(id ID) string
+
+// GetFetchBatchByID works like GetFetchBatch for IDs that aren't strings,
+// such as integers or composite structs. The idFn is only used to construct
+// the keys. The fetchFn receives, and returns, the IDs as they are.
+func GetFetchBatchByID[ID comparable, T any](
+	ctx context.Context,
+	client *Client,
+	ids []ID,
+	idFn IDFn[ID],
+	keyFn KeyFunc,
+	fetchFn BatchIDFetchFn[ID, T],
+) (map[ID]T, error) {
+	callIDs := make(map[string]ID, len(ids))
+	stringIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		stringID := idFn(id)
+		callIDs[stringID] = id
+		stringIDs = append(stringIDs, stringID)
+	}
+
+	// The IDs that are refreshed in the background are registered, because
+	// the refresh buffers could pass them to the fetchFn of another call.
+	keys := newBatchKeys(keyFn, stringIDs)
+	registerRefreshes := func(refreshIDs []string) {
+		client.usesBatchIDs.Store(true)
+		for _, stringID := range refreshIDs {
+			client.registerBatchID(keys.key(stringID), callIDs[stringID])
+		}
+	}
+
+	batchFetchFn := batchIDFetchFn(client, callIDs, idFn, keyFn, fetchFn)
+	records, err := getFetchBatchWithKeys(ctx, client, stringIDs, keys, batchFetchFn, nil, registerRefreshes)
+
+	result := make(map[ID]T, len(records))
+	for stringID, record := range records {
+		result[callIDs[stringID]] = record
+	}
+	return result, onlyCachedRecords(records, err)
+}
+
+// batchIDFetchFn adapts the fetchFn to the string IDs that are used by the
+// rest of the cache. Refresh buffering can merge the IDs of several calls
+// into a single batch, which is why the IDs that weren't passed to this call
+// are looked up in the registry of the client.
+func batchIDFetchFn[ID comparable, T any](
+	client *Client,
+	callIDs map[string]ID,
+	idFn IDFn[ID],
+	keyFn KeyFunc,
+	fetchFn BatchIDFetchFn[ID, T],
+) BatchFetchFn[T] {
+	return func(ctx context.Context, stringIDs []string) (map[string]T, error) {
+		ids := make([]ID, 0, len(stringIDs))
+		for _, stringID := range stringIDs {
+			if id, ok := callIDs[stringID]; ok {
+				ids = append(ids, id)
+				continue
+			}
+			if id, ok := lookupBatchID[ID](client, keyFn.Key(stringID)); ok {
+				ids = append(ids, id)
+			}
+		}
+
+		response, err := fetchFn(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+
+		records := make(map[string]T, len(response))
+		for id, record := range response {
+			records[idFn(id)] = record
+		}
+		return records, nil
+	}
+}
+
+// registerBatchID stores the ID of the key, so that it can be refreshed together with the IDs of other calls.
+func (c *Client) registerBatchID(key string, id any) {
+	if registered, ok := c.batchIDs.Load(key); ok && registered == id {
+		return
+	}
+	c.batchIDs.Store(key, id)
+}
+
+func lookupBatchID[ID comparable](c *Client, key string) (ID, bool) {
+	registered, ok := c.batchIDs.Load(key)
+	if !ok {
+		var zero ID
+		return zero, false
+	}
+	id, ok := registered.(ID)
+	return id, ok
+}
+
+// evicted is called by the shards whenever an entry is removed. It removes
+// the ID of the key from the registry, if GetFetchBatchByID has registered
+// any IDs, and calls the eviction hook.
+func (c *Client) evicted(key string, value any, reason EvictionReason) {
+	if c.usesBatchIDs.Load() {
+		c.batchIDs.Delete(key)
+	}
+	if c.evictionHook != nil {
+		c.evictionHook(key, value, reason)
+	}
+}
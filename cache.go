@@ -6,6 +6,7 @@ import (
 	"hash/fnv"
 	"maps"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,8 +21,31 @@ type MetricsRecorder interface {
 	ObserveCacheSize(callback func() int)
 }
 
+// KeyFunc turns the ID of a record into the key that it's cached under.
+type KeyFunc interface {
+	Key(id string) string
+}
+
+// GroupKeyFunc is a KeyFunc that also exposes the group that its keys belong
+// to. Refresh buffering uses the group to decide which IDs can share a batch,
+// so every key produced by the same GroupKeyFunc should be fetchable in a
+// single call to the BatchFetchFn. The keys returned by BatchKeyFn and
+// PermutatedBatchKeyFn implement this interface.
+type GroupKeyFunc interface {
+	KeyFunc
+	Group() string
+}
+
+// KeyFn allows ordinary functions to be used as a KeyFunc. A KeyFn has no
+// knowledge of how its keys are grouped, which means that refreshes for these
+// keys are performed straight away, even if refresh buffering is enabled.
 type KeyFn func(string) string
 
+// Key calls fn(id).
+func (fn KeyFn) Key(id string) string {
+	return fn(id)
+}
+
 type FetchFn[T any] func(ctx context.Context) (T, error)
 
 type BatchFetchFn[T any] func(ctx context.Context, ids []string) (map[string]T, error)
@@ -31,6 +55,7 @@ type Client struct {
 	shards           []*shard
 	nextShard        int
 	evictionInterval time.Duration
+	evictionHook     func(key string, value any, reason EvictionReason)
 	clock            Clock
 	metricsRecorder  MetricsRecorder
 
@@ -39,16 +64,46 @@ type Client struct {
 	maxRefreshTime   time.Duration
 	retryBaseDelay   time.Duration
 	storeMisses      bool
-
-	bufferMutex           sync.Mutex
-	bufferRefreshes       bool
-	maxBufferSize         int
-	bufferTimeout         time.Duration
-	bufferIdentifierIDs   map[string][]string
-	bufferIdentifierChans map[string]chan<- []string
+	refreshStrategy  refreshStrategy
+	xfetchBeta       float64
+
+	minAccesses              int64
+	accessWindow             time.Duration
+	proactiveRefreshTopK     int
+	proactiveRefreshInterval time.Duration
+	maxRefreshInterval       time.Duration
+	equalFn                  func(a, b any) bool
+
+	inFlightMutex sync.Mutex
+	inFlight      map[string]*inFlightCall
+
+	// namespaces holds the generation counter of each namespace.
+	namespaces sync.Map
+
+	bufferMutex         sync.Mutex
+	bufferConfig        bufferConfig
+	prefixBufferConfigs map[string]bufferConfig
+	refreshBuffers      map[string]*refreshBuffer
+	adaptiveBuffers     *adaptiveBuffers
+	// bufferedRefreshes counts the refreshes, and re-buffering of overflowing
+	// IDs, that run outside of a refresh buffer. bufferedRefreshesDone is
+	// closed when the count drops back to zero.
+	bufferedRefreshes     int
+	bufferedRefreshesDone chan struct{}
 
 	useRelativeTimeKeyFormat bool
-	keyTruncation            time.Duration
+	keyTimeBucket            TimeBucket
+	keyEncoding              KeyEncoding
+	keyHashThreshold         int
+
+	// batchIDs holds the IDs of the keys that GetFetchBatchByID is refreshing,
+	// which allows the refresh buffers to merge the IDs of several calls. The
+	// evictions only remove keys from it once usesBatchIDs has been set.
+	batchIDs     sync.Map
+	usesBatchIDs atomic.Bool
+
+	stats          stats
+	metricsLabeler func(key string) string
 }
 
 // validateArgs is a helper function that panics if the arguments are invalid.
@@ -87,9 +142,13 @@ func New(capacity, numShards int, ttl time.Duration, evictionPercentage int, opt
 	// Create a new client, and apply the options.
 	//nolint: exhaustruct // The options are going to set the remaining fields.
 	client := &Client{
-		ttl:              ttl,
-		clock:            NewClock(),
-		evictionInterval: ttl / time.Duration(numShards),
+		ttl:                 ttl,
+		clock:               NewClock(),
+		evictionInterval:    ttl / time.Duration(numShards),
+		prefixBufferConfigs: make(map[string]bufferConfig),
+		refreshBuffers:      make(map[string]*refreshBuffer),
+		adaptiveBuffers:     newAdaptiveBuffers(),
+		inFlight:            make(map[string]*inFlightCall),
 	}
 
 	for _, opt := range opts {
@@ -110,6 +169,16 @@ func New(capacity, numShards int, ttl time.Duration, evictionPercentage int, opt
 			client.minRefreshTime,
 			client.maxRefreshTime,
 			client.retryBaseDelay,
+			client.refreshStrategy,
+			client.xfetchBeta,
+			client.minAccesses,
+			client.accessWindow,
+			client.minAccesses > 0 || client.proactiveRefreshTopK > 0,
+			client.maxRefreshInterval,
+			client.equalFn,
+			client.evicted,
+			&client.stats,
+			client.metricsLabeler,
 		)
 		shards[i] = shard
 	}
@@ -119,6 +188,10 @@ func New(capacity, numShards int, ttl time.Duration, evictionPercentage int, opt
 	// Run evictions in a separate goroutine.
 	client.startEvictions()
 
+	if client.refreshesEnabled && client.proactiveRefreshTopK > 0 {
+		client.startProactiveRefreshes()
+	}
+
 	return client
 }
 
@@ -146,17 +219,27 @@ func (c *Client) startEvictions() {
 }
 
 func (c *Client) getShard(key string) *shard {
-	hasher := fnv.New64a()
-	_, _ = hasher.Write([]byte(key))
-	hash := hasher.Sum64()
-	shardIndex := hash % uint64(len(c.shards))
+	shardIndex := c.shardIndex(key)
 	if c.metricsRecorder != nil {
-		c.metricsRecorder.ShardIndex(int(shardIndex))
+		c.metricsRecorder.ShardIndex(shardIndex)
 	}
 	return c.shards[shardIndex]
 }
 
+func (c *Client) shardIndex(key string) int {
+	hasher := fnv.New64a()
+	_, _ = hasher.Write([]byte(key))
+	hash := hasher.Sum64()
+	return int(hash % uint64(len(c.shards)))
+}
+
 func (c *Client) reportCacheHits(cacheHit bool) {
+	if cacheHit {
+		c.stats.hits.Add(1)
+	} else {
+		c.stats.misses.Add(1)
+	}
+
 	if c.metricsRecorder == nil {
 		return
 	}
@@ -167,14 +250,36 @@ func (c *Client) reportCacheHits(cacheHit bool) {
 	c.metricsRecorder.CacheHit()
 }
 
-func (c *Client) set(key string, value any, isMissingRecord bool) bool {
+// writeToken should be captured before a fetch begins. Writing the response
+// with the token ensures that we won't overwrite any values that were written,
+// or deleted, while the fetch was in flight. The token is issued by the shard
+// of the key, and has to be released once the response has been written.
+func (c *Client) writeToken(key string) (uint64, func()) {
+	shard := c.shards[c.shardIndex(key)]
+	token := shard.tokens.acquire()
+	return token, func() {
+		shard.tokens.release(token)
+	}
+}
+
+func (c *Client) set(key string, w write) bool {
 	shard := c.getShard(key)
-	return shard.set(key, value, isMissingRecord)
+	return shard.set(key, w)
+}
+
+func (c *Client) setRefreshed(key string, w write) bool {
+	shard := c.getShard(key)
+	return shard.setRefreshed(key, w)
 }
 
 func get[T any](c *Client, key string) (value T, exists, ignore, refresh bool) {
+	return getWithInfo[T](c, key, nil)
+}
+
+// getWithInfo works like get, and populates the info unless it's nil.
+func getWithInfo[T any](c *Client, key string, info *EntryInfo) (value T, exists, ignore, refresh bool) {
 	shard := c.getShard(key)
-	entry, exists, ignore, refresh := shard.get(key)
+	entry, exists, ignore, refresh := shard.getWithInfo(key, info)
 	c.reportCacheHits(exists)
 
 	if !exists {
@@ -195,9 +300,126 @@ func Get[T any](c *Client, key string) (T, bool) {
 	return value, ok
 }
 
+// EntryInfo describes an entry in the cache.
+type EntryInfo struct {
+	// Age is the time that has passed since the entry was written.
+	Age       time.Duration
+	ExpiresAt time.Time
+	// RefreshAt is the earliest time at which the entry is refreshed.
+	// It's zero if the client hasn't been configured to refresh entries.
+	RefreshAt       time.Time
+	RefreshRetries  int
+	IsMissingRecord bool
+	// Accesses is the number of times that the entry has been read within
+	// the window of WithRefreshPopularityThreshold, or since it was written.
+	// The reads are only counted if the client has been configured with
+	// WithRefreshPopularityThreshold or WithProactiveRefreshes. Otherwise,
+	// Accesses is always zero and LastAccess is always the zero time.
+	Accesses int64
+	// LastAccess is zero if the entry hasn't been read since it was written.
+	LastAccess time.Time
+	// FetchDuration is the time it took to fetch the value.
+	// It's zero for values that were written with Set.
+	FetchDuration time.Duration
+}
+
+// GetWithMeta works like Get, and returns information about the entry as well.
+func GetWithMeta[T any](c *Client, key string) (T, EntryInfo, bool) {
+	var info EntryInfo
+	value, ok, _, _ := getWithInfo[T](c, key, &info)
+	if !ok {
+		return value, EntryInfo{}, false
+	}
+	return value, info, true
+}
+
+// Peek retrieves a value from the cache along with information about the
+// entry. Unlike Get, it doesn't record any metrics, access statistics, or
+// schedule a refresh of the entry.
+func Peek[T any](c *Client, key string) (T, EntryInfo, bool) {
+	var value T
+	entry, info, ok := c.shards[c.shardIndex(key)].peek(key)
+	if !ok {
+		return value, EntryInfo{}, false
+	}
+
+	val, ok := entry.(T)
+	if !ok {
+		return value, EntryInfo{}, false
+	}
+	return val, info, true
+}
+
+// Source describes where the value of a GetFetch call came from.
+type Source int
+
+const (
+	// SourceCache is used for values that were retrieved from the cache.
+	SourceCache Source = iota
+	// SourceFetch is used for values that were fetched by the call.
+	SourceFetch
+	// SourceCoalesced is used for values that were fetched by another call
+	// for the same key, which was already in flight.
+	SourceCoalesced
+	// SourceStale is used for values that were retrieved from the cache, and
+	// scheduled to be refreshed in the background.
+	SourceStale
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceCache:
+		return "cache"
+	case SourceFetch:
+		return "fetch"
+	case SourceCoalesced:
+		return "coalesced"
+	case SourceStale:
+		return "stale"
+	default:
+		return "unknown"
+	}
+}
+
+// ResultMeta describes the value that was returned for a key.
+type ResultMeta struct {
+	Source Source
+	// Age is the time that has passed since the value was written to the
+	// cache. It's zero for values that were fetched by the call.
+	Age time.Duration
+}
+
+// cachedResultMeta describes a value that was retrieved from the cache.
+func cachedResultMeta(info EntryInfo, refreshing bool) ResultMeta {
+	if refreshing {
+		return ResultMeta{Source: SourceStale, Age: info.Age}
+	}
+	return ResultMeta{Source: SourceCache, Age: info.Age}
+}
+
+// GetFetch attempts to retrieve the value from the cache. If it's not there,
+// it's going to be fetched using the fetchFn and written to the cache.
+// Concurrent calls for a key that is being fetched are going to wait for,
+// and share, the response of the fetch that is already in flight.
 func GetFetch[T any](ctx context.Context, client *Client, key string, fetchFn FetchFn[T]) (T, error) {
+	value, _, err := getFetch(ctx, client, key, fetchFn)
+	return value, err
+}
+
+// GetFetchWithMeta works like GetFetch, and describes where the value came from.
+func GetFetchWithMeta[T any](
+	ctx context.Context,
+	client *Client,
+	key string,
+	fetchFn FetchFn[T],
+) (T, ResultMeta, error) {
+	return getFetch(ctx, client, key, fetchFn)
+}
+
+func getFetch[T any](ctx context.Context, client *Client, key string, fetchFn FetchFn[T]) (T, ResultMeta, error) {
 	// Begin by checking if we have the item in our cache.
-	value, ok, shouldIgnore, shouldRefresh := get[T](client, key)
+	var info EntryInfo
+	value, ok, shouldIgnore, shouldRefresh := getWithInfo[T](client, key, &info)
 
 	// We have the item cached and we'll check if it should be refreshed in the background.
 	if shouldRefresh {
@@ -207,41 +429,156 @@ func GetFetch[T any](ctx context.Context, client *Client, key string, fetchFn Fe
 	}
 
 	if shouldIgnore {
-		return value, ErrMissingRecord
+		return value, cachedResultMeta(info, shouldRefresh), ErrMissingRecord
 	}
 
-	// If we don't have this item in our cache, we'll fetch it
-	if !ok {
-		response, err := fetchFn(ctx)
-		if err != nil {
-			// In case of an error, we'll only cache the response if the fetchFn returned an ErrMissingRecord.
-			if client.storeMisses && errors.Is(err, ErrStoreMissingRecord) {
-				client.set(key, response, true)
-			}
-			return response, err
-		}
+	if ok {
+		return value, cachedResultMeta(info, shouldRefresh), nil
+	}
+
+	// If we don't have this item in our cache, we'll fetch it.
+	value, coalesced, err := fetchOnce(ctx, client, key, func() (T, error) {
+		return fetchAndSet(ctx, client, key, fetchFn)
+	})
+	if coalesced {
+		return value, ResultMeta{Source: SourceCoalesced, Age: 0}, err
+	}
+	return value, ResultMeta{Source: SourceFetch, Age: 0}, err
+}
 
-		// Cache the response
-		client.set(key, response, false)
+// fetchAndSet fetches the value of a key that wasn't cached, and writes the response to the cache.
+func fetchAndSet[T any](ctx context.Context, client *Client, key string, fetchFn FetchFn[T]) (T, error) {
+	token, release := client.writeToken(key)
+	defer release()
+	start := client.clock.Now()
+	response, err := fetchFn(ctx)
+	fetchDuration := client.clock.Now().Sub(start)
+	client.reportFetch(key, fetchDuration)
+	if err != nil {
+		// In case of an error, we'll only cache the response if the fetchFn returned an ErrMissingRecord.
+		if client.storeMisses && errors.Is(err, ErrStoreMissingRecord) {
+			client.set(key, write{
+				value:           response,
+				isMissingRecord: true,
+				fetchDuration:   fetchDuration,
+				refresher:       keyRefresher(client, key, fetchFn),
+				validator:       "",
+				token:           token,
+			})
+		}
 		return response, err
 	}
 
-	return value, nil
+	// Cache the response
+	client.set(key, write{
+		value:           response,
+		isMissingRecord: false,
+		fetchDuration:   fetchDuration,
+		refresher:       keyRefresher(client, key, fetchFn),
+		validator:       "",
+		token:           token,
+	})
+	return response, nil
 }
 
 func GetFetchBatch[T any](
 	ctx context.Context,
 	client *Client,
 	ids []string,
-	keyFn KeyFn,
+	keyFn KeyFunc,
+	fetchFn BatchFetchFn[T],
+) (map[string]T, error) {
+	records, err := getFetchBatch(ctx, client, ids, keyFn, fetchFn, nil)
+	return records, onlyCachedRecords(records, err)
+}
+
+// GetFetchBatchWithMeta works like GetFetchBatch, and describes where the
+// value of each ID came from. Unlike GetFetch, the fetches of batches are
+// not coalesced with other calls that are in flight.
+func GetFetchBatchWithMeta[T any](
+	ctx context.Context,
+	client *Client,
+	ids []string,
+	keyFn KeyFunc,
+	fetchFn BatchFetchFn[T],
+) (map[string]T, map[string]ResultMeta, error) {
+	metas := make(map[string]ResultMeta, len(ids))
+	records, err := getFetchBatch(ctx, client, ids, keyFn, fetchFn, metas)
+	return records, metas, onlyCachedRecords(records, err)
+}
+
+// onlyCachedRecords returns ErrOnlyCachedRecords if the fetch failed, but some
+// of the records were cached. That lets the caller decide what to do.
+func onlyCachedRecords[T any](records map[string]T, err error) error {
+	if err != nil && len(records) > 0 {
+		return ErrOnlyCachedRecords
+	}
+	return err
+}
+
+// batchKeys holds the key of each ID of a batch. The keys are computed before
+// the batch is fetched, which ensures that the response is written to the same
+// keys even if the key function changes while the fetch is in flight, e.g.
+// because the namespace of a NamespacedKeyFn was bumped.
+type batchKeys struct {
+	keyFn KeyFunc
+	keys  map[string]string
+}
+
+func newBatchKeys(keyFn KeyFunc, ids []string) batchKeys {
+	keys := make(map[string]string, len(ids))
+	for _, id := range ids {
+		keys[id] = keyFn.Key(id)
+	}
+	return batchKeys{keyFn: keyFn, keys: keys}
+}
+
+// key returns the key of the ID. IDs that weren't part of the batch, but
+// were still returned by the fetch, are given the current key of the ID.
+func (b batchKeys) key(id string) string {
+	if key, ok := b.keys[id]; ok {
+		return key
+	}
+	return b.keyFn.Key(id)
+}
+
+// getFetchBatch populates the metas with the source of each record, unless the
+// map is nil. If the fetch fails, the cached records are returned along with
+// the error of the fetchFn.
+func getFetchBatch[T any](
+	ctx context.Context,
+	client *Client,
+	ids []string,
+	keyFn KeyFunc,
+	fetchFn BatchFetchFn[T],
+	metas map[string]ResultMeta,
+) (map[string]T, error) {
+	return getFetchBatchWithKeys(ctx, client, ids, newBatchKeys(keyFn, ids), fetchFn, metas, nil)
+}
+
+// getFetchBatchWithKeys works like getFetchBatch for keys that have already
+// been computed. If refreshing isn't nil, it's called with the IDs that are
+// about to be refreshed in the background.
+func getFetchBatchWithKeys[T any](
+	ctx context.Context,
+	client *Client,
+	ids []string,
+	keys batchKeys,
 	fetchFn BatchFetchFn[T],
+	metas map[string]ResultMeta,
+	refreshing func(ids []string),
 ) (map[string]T, error) {
+	keyFn := keys.keyFn
 	cachedRecords := make(map[string]T)
 	cacheMisses := make([]string, 0)
 	idsToRefresh := make([]string, 0)
+	var info *EntryInfo
+	if metas != nil {
+		info = &EntryInfo{}
+	}
 	for _, id := range ids {
-		key := keyFn(id)
-		value, exists, shouldIgnore, shouldRefresh := get[T](client, key)
+		key := keys.key(id)
+		value, exists, shouldIgnore, shouldRefresh := getWithInfo[T](client, key, info)
 
 		// Check if the record should be refreshed in the background.
 		if shouldRefresh {
@@ -259,19 +596,20 @@ func GetFetchBatch[T any](
 		}
 
 		cachedRecords[id] = value
+		if metas != nil {
+			metas[id] = cachedResultMeta(*info, shouldRefresh)
+		}
 	}
 
-	// Refresh records in the background
+	// Refresh records in the background. The records are going to be refreshed
+	// straight away unless refresh buffering is enabled for the batch group.
 	if len(idsToRefresh) > 0 {
-		if client.bufferRefreshes {
-			safeGo(func() {
-				bufferBatchRefresh(client, idsToRefresh, keyFn, fetchFn)
-			})
-		} else {
-			safeGo(func() {
-				refreshBatch(client, idsToRefresh, keyFn, fetchFn)
-			})
+		if refreshing != nil {
+			refreshing(idsToRefresh)
 		}
+		safeGo(func() {
+			bufferBatchRefresh(client, idsToRefresh, keyFn, fetchFn)
+		})
 	}
 
 	// If we were able to retrieve all records from the cache, we can return them straight away.
@@ -280,13 +618,13 @@ func GetFetchBatch[T any](
 	}
 
 	// Fetch the missing records.
+	tokens, release := client.batchWriteTokens(keys, cacheMisses)
+	defer release()
+	start := client.clock.Now()
 	response, err := fetchFn(ctx, cacheMisses)
+	fetchDuration := client.clock.Now().Sub(start)
+	client.reportFetch(keys.key(cacheMisses[0]), fetchDuration)
 	if err != nil {
-		// We had some records in the cache, but the remaining records couldn't be retrieved. Therefore,
-		// we'll return a ErrOnlyCachedRecords error, and let the caller decide what to do.
-		if len(cachedRecords) > 0 {
-			return cachedRecords, ErrOnlyCachedRecords
-		}
 		return cachedRecords, err
 	}
 
@@ -294,29 +632,71 @@ func GetFetchBatch[T any](
 	if client.storeMisses && len(response) < len(cacheMisses) {
 		for _, id := range cacheMisses {
 			if v, ok := response[id]; !ok {
-				client.set(keyFn(id), v, true)
+				key := keys.key(id)
+				client.set(key, write{
+					value:           v,
+					isMissingRecord: true,
+					fetchDuration:   fetchDuration,
+					refresher:       batchRefresher(client, id, keyFn, fetchFn),
+					validator:       "",
+					token:           tokens.token(client, key),
+				})
 			}
 		}
 	}
 
 	// Cache the fetched records.
 	for id, record := range response {
-		client.set(keyFn(id), record, false)
+		key := keys.key(id)
+		client.set(key, write{
+			value:           record,
+			isMissingRecord: false,
+			fetchDuration:   fetchDuration,
+			refresher:       batchRefresher(client, id, keyFn, fetchFn),
+			validator:       "",
+			token:           tokens.token(client, key),
+		})
 	}
 
 	// Merge the cached records with the fetched records.
 	maps.Copy(cachedRecords, response)
+	if metas != nil {
+		for id := range response {
+			metas[id] = ResultMeta{Source: SourceFetch, Age: 0}
+		}
+	}
 
 	return cachedRecords, nil
 }
 
 // Set sets a value in the cache. Returns true if it triggered an eviction.
 func Set(c *Client, key string, value any) bool {
-	return c.set(key, value, false)
+	return c.set(key, write{
+		value:           value,
+		isMissingRecord: false,
+		fetchDuration:   0,
+		refresher:       nil,
+		validator:       "",
+		token:           unconditionalWrite,
+	})
 }
 
-func SetMany[T any](c *Client, records map[string]T, cacheKeyFn KeyFn) {
+// Delete removes the key from the cache. Any fetches or refreshes of the key
+// that are in flight are not going to write their responses to the cache.
+func Delete(c *Client, key string) {
+	shard := c.getShard(key)
+	shard.delete(key)
+}
+
+func SetMany[T any](c *Client, records map[string]T, cacheKeyFn KeyFunc) {
 	for id, value := range records {
-		c.set(cacheKeyFn(id), value, false)
+		c.set(cacheKeyFn.Key(id), write{
+			value:           value,
+			isMissingRecord: false,
+			fetchDuration:   0,
+			refresher:       nil,
+			validator:       "",
+			token:           unconditionalWrite,
+		})
 	}
 }
@@ -3,11 +3,14 @@ package sturdyc_test
 import (
 	"context"
 	"errors"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/creativecreature/sturdyc"
+	"github.com/google/go-cmp/cmp"
 )
 
 type distributionTestCase struct {
@@ -658,3 +661,1503 @@ func TestGetFetchBatchStampedeProtection(t *testing.T) {
 	<-fetchObserver.FetchCompleted
 	fetchObserver.AssertMaxFetchCount(t, 4)
 }
+
+func TestXFetchRefreshesExpensiveEntriesEarly(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithXFetchRefreshStrategy(1_000_000),
+		sturdyc.WithClock(clock),
+	)
+
+	ids := make([]string, 0, 100)
+	for i := 1; i <= 100; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+
+	// The fetch function moves the clock forward to make it look like the
+	// upstream took a second to respond, which is recorded for each entry.
+	var mu sync.Mutex
+	var requestedIDs []string
+	fetchCompleted := make(chan struct{}, 1)
+	fetchFn := func(_ context.Context, batch []string) (map[string]string, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		mu.Lock()
+		requestedIDs = batch
+		mu.Unlock()
+		clock.Add(time.Second)
+		response := make(map[string]string, len(batch))
+		for _, id := range batch {
+			response[id] = "value" + id
+		}
+		return response, nil
+	}
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	<-fetchCompleted
+
+	// Entries are never refreshed before the min refresh delay.
+	clock.Add(minRefreshDelay - time.Second)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	if len(requestedIDs) != len(ids) {
+		t.Fatalf("expected no refreshes, got %d", len(requestedIDs))
+	}
+	mu.Unlock()
+
+	// With a beta this large, nearly every entry should be
+	// refreshed shortly after the min refresh delay.
+	clock.Add(time.Second * 2)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	<-fetchCompleted
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requestedIDs) < 90 {
+		t.Errorf("expected at least 90 early refreshes, got %d", len(requestedIDs))
+	}
+}
+
+func TestXFetchRefreshesEntriesAtTheDeadline(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithXFetchRefreshStrategy(1),
+		sturdyc.WithClock(clock),
+	)
+
+	// Values that are written with Set have no fetch duration. Hence, they
+	// should stay put until the max refresh delay, regardless of the beta.
+	sturdyc.Set(client, "key", "value")
+	fetchObserver := NewFetchObserver(1)
+	fetchObserver.Response("1")
+	clock.Add(maxRefreshDelay - time.Second)
+	sturdyc.GetFetch(ctx, client, "key", fetchObserver.Fetch)
+	time.Sleep(10 * time.Millisecond)
+	fetchObserver.AssertFetchCount(t, 0)
+
+	clock.Add(time.Second * 2)
+	sturdyc.GetFetch(ctx, client, "key", fetchObserver.Fetch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 1)
+}
+
+func TestColdEntriesAreNotRefreshed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 10
+	numShards := 1
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshPopularityThreshold(3, time.Minute),
+		sturdyc.WithClock(clock),
+	)
+
+	fetchObserver := NewFetchObserver(1)
+	fetchObserver.Response("1")
+	sturdyc.GetFetch(ctx, client, "1", fetchObserver.Fetch)
+	<-fetchObserver.FetchCompleted
+
+	// The entry has to be read 3 times within a minute before it gets refreshed.
+	clock.Add(maxRefreshDelay + time.Second)
+	for i := 0; i < 2; i++ {
+		sturdyc.GetFetch(ctx, client, "1", fetchObserver.Fetch)
+	}
+	time.Sleep(10 * time.Millisecond)
+	fetchObserver.AssertFetchCount(t, 1)
+
+	// Moving the clock past the window should reset the count.
+	clock.Add(time.Minute + time.Second)
+	for i := 0; i < 2; i++ {
+		sturdyc.GetFetch(ctx, client, "1", fetchObserver.Fetch)
+	}
+	time.Sleep(10 * time.Millisecond)
+	fetchObserver.AssertFetchCount(t, 1)
+
+	sturdyc.GetFetch(ctx, client, "1", fetchObserver.Fetch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 2)
+}
+
+func TestHotEntriesAreRefreshedProactively(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 10
+	numShards := 2
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithProactiveRefreshes(1, maxRefreshDelay),
+		sturdyc.WithClock(clock),
+	)
+
+	hotObserver := NewFetchObserver(1)
+	hotObserver.Response("hot")
+	coldObserver := NewFetchObserver(1)
+	coldObserver.Response("cold")
+	sturdyc.GetFetch(ctx, client, "hot", hotObserver.Fetch)
+	<-hotObserver.FetchCompleted
+	sturdyc.GetFetch(ctx, client, "cold", coldObserver.Fetch)
+	<-coldObserver.FetchCompleted
+
+	// Read both entries before they're due for a refresh, but the hot one more often.
+	for i := 0; i < 5; i++ {
+		sturdyc.GetFetch(ctx, client, "hot", hotObserver.Fetch)
+	}
+	sturdyc.GetFetch(ctx, client, "cold", coldObserver.Fetch)
+
+	// Both entries are going to become due for a refresh before the scheduler runs
+	// again, but it's only allowed to refresh one of them. We'll sleep briefly to
+	// make sure that the scheduler has created its ticker before moving the clock.
+	time.Sleep(10 * time.Millisecond)
+	clock.Add(maxRefreshDelay)
+	<-hotObserver.FetchCompleted
+	time.Sleep(10 * time.Millisecond)
+	hotObserver.AssertFetchCount(t, 2)
+	coldObserver.AssertFetchCount(t, 1)
+}
+
+type versionedRecord struct {
+	Version int
+}
+
+func (r versionedRecord) Equal(other versionedRecord) bool {
+	return r.Version == other.Version
+}
+
+func TestUnchangedValuesAreRefreshedLessOften(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 10
+	numShards := 1
+	ttl := time.Hour * 24
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	refreshRetryInterval := time.Millisecond * 10
+	maxRefreshInterval := time.Minute * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	metricsRecorder := newTestMetricsRecorder(numShards)
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithChangeAwareRefreshes(maxRefreshInterval, nil),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+
+	var mu sync.Mutex
+	var fetchCount int
+	version := 1
+	fetchCompleted := make(chan struct{}, 1)
+	fetchFn := func(_ context.Context) (versionedRecord, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		mu.Lock()
+		defer mu.Unlock()
+		fetchCount++
+		return versionedRecord{Version: version}, nil
+	}
+	assertFetchCount := func(want int) {
+		t.Helper()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if fetchCount != want {
+			t.Fatalf("expected fetch count %d, got %d", want, fetchCount)
+		}
+	}
+
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+
+	// The first refresh returns the same value, which should double the interval.
+	clock.Add(maxRefreshDelay)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	clock.Add(minRefreshDelay*2 - time.Second)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	assertFetchCount(2)
+
+	// The interval should keep growing as long as the value stays the same.
+	clock.Add(maxRefreshDelay*2 - (minRefreshDelay*2 - time.Second))
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	clock.Add(minRefreshDelay*4 - time.Second)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	assertFetchCount(3)
+
+	// Next, we'll change the value. That should shorten the interval again.
+	mu.Lock()
+	version = 2
+	mu.Unlock()
+	clock.Add(maxRefreshDelay*4 - (minRefreshDelay*4 - time.Second))
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	clock.Add(maxRefreshDelay * 2)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	assertFetchCount(5)
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.refreshes != 4 || metricsRecorder.changedValues != 1 {
+		t.Errorf("expected 1 of 4 refreshes to have changed the value, got %d of %d",
+			metricsRecorder.changedValues, metricsRecorder.refreshes,
+		)
+	}
+}
+
+func TestChangedValuesShortenTheIntervalAfterReachingTheMax(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute + time.Second
+	maxRefreshInterval := time.Minute * 16
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(10, 1, time.Hour*24, 10,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, time.Millisecond*10, true),
+		sturdyc.WithChangeAwareRefreshes(maxRefreshInterval, nil),
+		sturdyc.WithClock(clock),
+	)
+
+	var mu sync.Mutex
+	var fetchCount int
+	version := 1
+	fetchCompleted := make(chan struct{}, 1)
+	fetchFn := func(_ context.Context) (versionedRecord, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		mu.Lock()
+		defer mu.Unlock()
+		fetchCount++
+		return versionedRecord{Version: version}, nil
+	}
+
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+
+	// Keep the value unchanged long after the interval has reached the max.
+	for i := 0; i < 30; i++ {
+		clock.Add(maxRefreshInterval + time.Second)
+		sturdyc.GetFetch(ctx, client, "key", fetchFn)
+		waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	}
+
+	// The first refresh that changes the value should halve the interval.
+	mu.Lock()
+	version = 2
+	mu.Unlock()
+	clock.Add(maxRefreshInterval + time.Second)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+
+	// The next refresh should happen before the max refresh interval has passed.
+	clock.Add(maxRefreshInterval/2 + maxRefreshDelay)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	waitForWrite[versionedRecord](t, client, "key", fetchCompleted)
+	mu.Lock()
+	defer mu.Unlock()
+	if fetchCount != 33 {
+		t.Errorf("expected 33 fetches, got %d", fetchCount)
+	}
+}
+
+func TestRevalidationsCanLeaveTheCachedValueUnmodified(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 10
+	numShards := 1
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithClock(clock),
+	)
+
+	var mu sync.Mutex
+	var validators []string
+	modified := false
+	fetchCompleted := make(chan struct{}, 1)
+	revalidateFn := func(_ context.Context, cached string, validator string) (string, string, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		mu.Lock()
+		defer mu.Unlock()
+		validators = append(validators, validator)
+		if validator == "" {
+			return "value1", "etag1", nil
+		}
+		if !modified {
+			return cached, validator, sturdyc.ErrNotModified
+		}
+		return "value2", "etag2", nil
+	}
+
+	res, err := sturdyc.GetFetchRevalidate(ctx, client, "key", revalidateFn)
+	<-fetchCompleted
+	if err != nil || res != "value1" {
+		t.Fatalf("expected value1, got %q (err: %v)", res, err)
+	}
+
+	// The record hasn't been modified, so the cached value should be kept.
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetchRevalidate(ctx, client, "key", revalidateFn)
+	<-fetchCompleted
+	time.Sleep(10 * time.Millisecond)
+	if res, ok := sturdyc.Get[string](client, "key"); !ok || res != "value1" {
+		t.Fatalf("expected the cached value to be kept, got %q", res)
+	}
+
+	mu.Lock()
+	modified = true
+	mu.Unlock()
+
+	// The original entry would have expired by now, so getting the cached value
+	// back means that the not modified response extended its lifetime.
+	clock.Add(ttl - time.Minute)
+	res, err = sturdyc.GetFetchRevalidate(ctx, client, "key", revalidateFn)
+	<-fetchCompleted
+	if err != nil || res != "value1" {
+		t.Fatalf("expected the revalidated value1, got %q (err: %v)", res, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if res, ok := sturdyc.Get[string](client, "key"); !ok || res != "value2" {
+		t.Fatalf("expected the modified value to be cached, got %q", res)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"", "etag1", "etag1"}
+	if !cmp.Equal(want, validators) {
+		t.Error(cmp.Diff(want, validators))
+	}
+}
+
+func TestRefreshesDoNotOverwriteNewerValues(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 10
+	numShards := 1
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	metricsRecorder := newTestMetricsRecorder(numShards)
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+
+	sturdyc.Set(client, "key", "value1")
+
+	// Trigger a refresh, and write a new value to the cache while it's in flight.
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	fetchCompleted := make(chan struct{})
+	fetchFn := func(_ context.Context) (string, error) {
+		defer close(fetchCompleted)
+		close(fetchStarted)
+		<-releaseFetch
+		return "refreshed", nil
+	}
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetch(ctx, client, "key", fetchFn)
+	<-fetchStarted
+	sturdyc.Set(client, "key", "value2")
+	close(releaseFetch)
+	<-fetchCompleted
+	time.Sleep(10 * time.Millisecond)
+
+	if res, ok := sturdyc.Get[string](client, "key"); !ok || res != "value2" {
+		t.Errorf("expected the refresh to not overwrite value2, got %q", res)
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.droppedWrites != 1 {
+		t.Errorf("expected 1 dropped write, got %d", metricsRecorder.droppedWrites)
+	}
+}
+
+func TestConcurrentFetchesOfMissingKeysAreNotStale(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	metricsRecorder := newTestMetricsRecorder(1)
+	client := sturdyc.New(10, 1, time.Hour, 10, sturdyc.WithMetrics(metricsRecorder))
+	keyFn := client.BatchKeyFn("item")
+
+	// Batches aren't coalesced with the fetches of single keys,
+	// which lets both of them fetch the key while it's missing.
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	batchStarted := make(chan struct{})
+	releaseBatch := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sturdyc.GetFetch(ctx, client, keyFn.Key("1"), func(_ context.Context) (string, error) {
+			close(fetchStarted)
+			<-releaseFetch
+			return "fetched", nil
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		sturdyc.GetFetchBatch(ctx, client, []string{"1"}, keyFn, func(_ context.Context, ids []string) (map[string]string, error) {
+			close(batchStarted)
+			<-releaseBatch
+			return map[string]string{"1": "batched"}, nil
+		})
+	}()
+	<-fetchStarted
+	<-batchStarted
+	close(releaseFetch)
+	for {
+		if _, ok := sturdyc.Get[string](client, keyFn.Key("1")); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(releaseBatch)
+	wg.Wait()
+
+	if res, ok := sturdyc.Get[string](client, keyFn.Key("1")); !ok || res != "fetched" {
+		t.Errorf("expected the first response to be kept, got %q", res)
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.droppedWrites != 0 {
+		t.Errorf("expected no dropped writes to be reported, got %d", metricsRecorder.droppedWrites)
+	}
+}
+
+func TestFetchesDoNotWriteBackDeletedKeys(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(10, 1, time.Hour, 10)
+
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	fetchFn := func(_ context.Context) (string, error) {
+		close(fetchStarted)
+		<-releaseFetch
+		return "value", nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		res, err := sturdyc.GetFetch(ctx, client, "key", fetchFn)
+		if err != nil || res != "value" {
+			t.Errorf("expected the fetched value to be returned, got %q (err: %v)", res, err)
+		}
+	}()
+
+	<-fetchStarted
+	sturdyc.Delete(client, "key")
+	close(releaseFetch)
+	<-done
+
+	if _, ok := sturdyc.Get[string](client, "key"); ok {
+		t.Error("expected the key that was deleted during the fetch to not be cached")
+	}
+
+	// Fetches that begin after the delete should be written to the cache.
+	res, err := sturdyc.GetFetch(ctx, client, "key", func(_ context.Context) (string, error) {
+		return "value", nil
+	})
+	if err != nil || res != "value" {
+		t.Fatalf("expected the fetched value to be returned, got %q (err: %v)", res, err)
+	}
+	if _, ok := sturdyc.Get[string](client, "key"); !ok {
+		t.Error("expected the key to be cached")
+	}
+
+	// Deleting another key, while a fetch is in flight, shouldn't affect it.
+	wantedStarted := make(chan struct{})
+	releaseWanted := make(chan struct{})
+	wantedDone := make(chan struct{})
+	go func() {
+		defer close(wantedDone)
+		sturdyc.GetFetch(ctx, client, "wanted", func(_ context.Context) (string, error) {
+			close(wantedStarted)
+			<-releaseWanted
+			return "value", nil
+		})
+	}()
+	<-wantedStarted
+	sturdyc.Delete(client, "other")
+	sturdyc.Delete(client, "key")
+	close(releaseWanted)
+	<-wantedDone
+
+	if _, ok := sturdyc.Get[string](client, "wanted"); !ok {
+		t.Error("expected the fetch to be cached even though other keys were deleted")
+	}
+}
+
+func TestComputeDoesNotLoseConcurrentUpdates(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 10)
+	numGoroutines := 50
+	numIncrements := 100
+
+	var wg sync.WaitGroup
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numIncrements; j++ {
+				sturdyc.Compute(client, "counter", func(old int, _ bool) (int, sturdyc.ComputeAction) {
+					return old + 1, sturdyc.ComputeStore
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if res, ok := sturdyc.Get[int](client, "counter"); !ok || res != numGoroutines*numIncrements {
+		t.Errorf("expected the counter to be %d, got %d", numGoroutines*numIncrements, res)
+	}
+
+	res, ok := sturdyc.Compute(client, "counter", func(old int, exists bool) (int, sturdyc.ComputeAction) {
+		if !exists || old != numGoroutines*numIncrements {
+			t.Errorf("expected the current value to be passed to the function, got %d", old)
+		}
+		return 0, sturdyc.ComputeDelete
+	})
+	if ok || res != 0 {
+		t.Errorf("expected the counter to have been deleted, got %d", res)
+	}
+	if _, ok := sturdyc.Get[int](client, "counter"); ok {
+		t.Error("expected the counter to have been deleted")
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	t.Parallel()
+
+	clock := sturdyc.NewTestClock(time.Now())
+	ttl := time.Hour
+	client := sturdyc.New(100, 1, ttl, 10, sturdyc.WithClock(clock))
+
+	if !sturdyc.SetIfAbsent(client, "key", "value1") {
+		t.Error("expected the value to be written to an absent key")
+	}
+	if sturdyc.SetIfAbsent(client, "key", "value2") {
+		t.Error("expected the value to not overwrite an existing key")
+	}
+
+	equal := func(a, b string) bool { return a == b }
+	if sturdyc.CompareAndSwap(client, "key", "value2", "value3", equal) {
+		t.Error("expected the swap to fail when the old value doesn't match")
+	}
+	if !sturdyc.CompareAndSwap(client, "key", "value1", "value3", equal) {
+		t.Error("expected the swap to succeed when the old value matches")
+	}
+	if sturdyc.CompareAndSwap(client, "missing", "", "value", equal) {
+		t.Error("expected the swap to fail for a missing key")
+	}
+
+	if res, loaded := sturdyc.GetOrSet(client, "key", "value4"); !loaded || res != "value3" {
+		t.Errorf("expected the cached value3 to be loaded, got %q", res)
+	}
+	if res, loaded := sturdyc.GetOrSet(client, "other", "value5"); loaded || res != "value5" {
+		t.Errorf("expected value5 to be written, got %q", res)
+	}
+
+	// Expired entries should be treated as absent.
+	clock.Add(ttl + time.Second)
+	if !sturdyc.SetIfAbsent(client, "key", "value6") {
+		t.Error("expected the value to replace an expired entry")
+	}
+	if res, ok := sturdyc.Get[string](client, "key"); !ok || res != "value6" {
+		t.Errorf("expected value6, got %q", res)
+	}
+}
+
+func TestConditionalWritesKeepValuesOfOtherTypes(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(100, 1, time.Hour, 10,
+		sturdyc.WithStampedeProtection(time.Minute, time.Minute*2, time.Second, true),
+	)
+
+	// A value of another type exists, and should be left untouched.
+	sturdyc.Set(client, "number", 1)
+	if res, loaded := sturdyc.GetOrSet(client, "number", "value"); !loaded || res != "" {
+		t.Errorf("expected the number to be loaded as the zero value, got %q", res)
+	}
+	if sturdyc.CompareAndSwap(client, "number", "", "value", func(a, b string) bool { return a == b }) {
+		t.Error("expected the swap to fail for a value of another type")
+	}
+	_, ok := sturdyc.Compute(client, "number", func(_ string, exists bool) (string, sturdyc.ComputeAction) {
+		if !exists {
+			t.Error("expected the value of another type to exist")
+		}
+		return "", sturdyc.ComputeKeep
+	})
+	if res, _ := sturdyc.Get[int](client, "number"); !ok || res != 1 {
+		t.Errorf("expected the number to be kept, got %d", res)
+	}
+
+	// A nil value exists as well.
+	sturdyc.Set(client, "nil", nil)
+	if sturdyc.SetIfAbsent(client, "nil", "value") {
+		t.Error("expected the value to not overwrite an existing nil value")
+	}
+	if res, loaded := sturdyc.GetOrSet[any](client, "nil", "value"); !loaded || res != nil {
+		t.Errorf("expected the nil value to be loaded, got %v", res)
+	}
+	if !sturdyc.CompareAndSwap[any](client, "nil", nil, "value", func(a, b any) bool { return a == b }) {
+		t.Error("expected the nil value to be swapped")
+	}
+
+	// So does a missing record.
+	sturdyc.GetFetch(ctx, client, "missing", func(_ context.Context) (string, error) {
+		return "", sturdyc.ErrStoreMissingRecord
+	})
+	if res, loaded := sturdyc.GetOrSet(client, "missing", "value"); !loaded || res != "" {
+		t.Errorf("expected the missing record to be loaded as the zero value, got %q", res)
+	}
+	if sturdyc.CompareAndSwap(client, "missing", "", "value", func(a, b string) bool { return a == b }) {
+		t.Error("expected the swap to fail for a missing record")
+	}
+	if _, err := sturdyc.GetFetch(ctx, client, "missing", func(_ context.Context) (string, error) {
+		return "fetched", nil
+	}); !errors.Is(err, sturdyc.ErrMissingRecord) {
+		t.Errorf("expected the missing record to be kept, got %v", err)
+	}
+}
+
+func TestComputeRespectsTheCapacity(t *testing.T) {
+	t.Parallel()
+
+	capacity := 10
+	client := sturdyc.New(capacity, 1, time.Hour, 50)
+	for i := 0; i < capacity*3; i++ {
+		sturdyc.GetOrSet(client, strconv.Itoa(i), i)
+	}
+	if client.Size() > capacity {
+		t.Errorf("expected the size to not exceed %d, got %d", capacity, client.Size())
+	}
+}
+
+func TestPeekDoesNotHaveSideEffects(t *testing.T) {
+	t.Parallel()
+
+	numShards := 1
+	ttl := time.Hour
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	refreshRetryInterval := time.Millisecond * 10
+	start := time.Now()
+	clock := sturdyc.NewTestClock(start)
+	metricsRecorder := newTestMetricsRecorder(numShards)
+	client := sturdyc.New(10, numShards, ttl, 10,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshPopularityThreshold(1, 0),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+	sturdyc.Set(client, "key", "value")
+	metricsRecorder.Lock()
+	shardIndexes := metricsRecorder.shards[0]
+	metricsRecorder.Unlock()
+
+	clock.Add(maxRefreshDelay + time.Second)
+	res, info, ok := sturdyc.Peek[string](client, "key")
+	if !ok || res != "value" {
+		t.Fatalf("expected to peek at the value, got %q", res)
+	}
+	if info.Age != maxRefreshDelay+time.Second {
+		t.Errorf("expected the age to be %v, got %v", maxRefreshDelay+time.Second, info.Age)
+	}
+	if !info.ExpiresAt.Equal(start.Add(ttl)) {
+		t.Errorf("expected the entry to expire at %v, got %v", start.Add(ttl), info.ExpiresAt)
+	}
+	if info.RefreshAt.Before(start.Add(minRefreshDelay)) || info.RefreshAt.After(start.Add(maxRefreshDelay)) {
+		t.Errorf("expected the refresh time to be within the refresh delays, got %v", info.RefreshAt)
+	}
+	if info.Accesses != 0 || !info.LastAccess.IsZero() || info.RefreshRetries != 0 || info.IsMissingRecord {
+		t.Errorf("unexpected entry info: %+v", info)
+	}
+	if _, _, ok := sturdyc.Peek[int](client, "key"); ok {
+		t.Error("expected peeking with the wrong type to fail")
+	}
+	if _, _, ok := sturdyc.Peek[string](client, "missing"); ok {
+		t.Error("expected peeking at a missing key to fail")
+	}
+
+	metricsRecorder.Lock()
+	if metricsRecorder.cacheHits != 0 || metricsRecorder.cacheMisses != 0 || metricsRecorder.shards[0] != shardIndexes {
+		t.Errorf("expected peeking to not record any metrics, got %d hits, %d misses, and %d shard indexes",
+			metricsRecorder.cacheHits, metricsRecorder.cacheMisses, metricsRecorder.shards[0]-shardIndexes,
+		)
+	}
+	metricsRecorder.Unlock()
+
+	// The refresh should not have been scheduled by peeking at the entry.
+	res, info, ok = sturdyc.GetWithMeta[string](client, "key")
+	if !ok || res != "value" {
+		t.Fatalf("expected to get the value, got %q", res)
+	}
+	if info.RefreshRetries != 1 || info.Accesses != 1 || !info.LastAccess.Equal(clock.Now()) {
+		t.Errorf("expected the read to be recorded and the refresh to be scheduled, got %+v", info)
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.cacheHits != 1 {
+		t.Errorf("expected GetWithMeta to record a cache hit, got %d", metricsRecorder.cacheHits)
+	}
+}
+
+func TestAccessesAreOnlyTrackedWhenTheyAffectRefreshes(t *testing.T) {
+	t.Parallel()
+
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(10, 1, time.Hour, 10, sturdyc.WithClock(clock))
+	sturdyc.Set(client, "key", "value")
+	for i := 0; i < 3; i++ {
+		sturdyc.Get[string](client, "key")
+	}
+	if _, info, _ := sturdyc.GetWithMeta[string](client, "key"); info.Accesses != 0 || !info.LastAccess.IsZero() {
+		t.Errorf("expected the reads to not be counted, got %+v", info)
+	}
+
+	tracking := sturdyc.New(10, 1, time.Hour, 10,
+		sturdyc.WithRefreshPopularityThreshold(2, time.Minute),
+		sturdyc.WithClock(clock),
+	)
+	sturdyc.Set(tracking, "key", "value")
+	for i := 0; i < 3; i++ {
+		sturdyc.Get[string](tracking, "key")
+	}
+	if _, info, _ := sturdyc.GetWithMeta[string](tracking, "key"); info.Accesses != 4 || !info.LastAccess.Equal(clock.Now()) {
+		t.Errorf("expected the reads to be counted, got %+v", info)
+	}
+}
+
+func TestGetFetchWithMetaDescribesTheSource(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(10, 1, time.Hour, 10,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithClock(clock),
+	)
+
+	fetchCompleted := make(chan struct{}, 1)
+	fetchFn := func(_ context.Context) (string, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		return "value", nil
+	}
+
+	_, meta, err := sturdyc.GetFetchWithMeta(ctx, client, "key", fetchFn)
+	<-fetchCompleted
+	if err != nil || meta.Source != sturdyc.SourceFetch || meta.Age != 0 {
+		t.Errorf("expected the value to be fetched, got %s with age %v (err: %v)", meta.Source, meta.Age, err)
+	}
+
+	clock.Add(time.Second * 30)
+	_, meta, err = sturdyc.GetFetchWithMeta(ctx, client, "key", fetchFn)
+	if err != nil || meta.Source != sturdyc.SourceCache || meta.Age != time.Second*30 {
+		t.Errorf("expected the value to be cached for 30s, got %s with age %v (err: %v)", meta.Source, meta.Age, err)
+	}
+
+	clock.Add(maxRefreshDelay)
+	_, meta, err = sturdyc.GetFetchWithMeta(ctx, client, "key", fetchFn)
+	<-fetchCompleted
+	if err != nil || meta.Source != sturdyc.SourceStale || meta.Age != maxRefreshDelay+time.Second*30 {
+		t.Errorf("expected the value to be stale, got %s with age %v (err: %v)", meta.Source, meta.Age, err)
+	}
+}
+
+func TestConcurrentFetchesOfAKeyAreCoalesced(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(10, 1, time.Hour, 10)
+
+	var mu sync.Mutex
+	var fetchCount int
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	fetchFn := func(_ context.Context) (string, error) {
+		mu.Lock()
+		fetchCount++
+		mu.Unlock()
+		close(fetchStarted)
+		<-releaseFetch
+		return "value", nil
+	}
+
+	numGoroutines := 10
+	sources := make(chan sturdyc.Source, numGoroutines)
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func() {
+			defer wg.Done()
+			res, meta, err := sturdyc.GetFetchWithMeta(ctx, client, "key", fetchFn)
+			if err != nil || res != "value" {
+				t.Errorf("expected the fetched value, got %q (err: %v)", res, err)
+			}
+			sources <- meta.Source
+		}()
+		// Make sure that the first goroutine is the one performing the fetch.
+		if i == 0 {
+			<-fetchStarted
+		}
+	}
+
+	// Callers that are waiting for the in-flight fetch should return if their context is cancelled.
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := sturdyc.GetFetch(cancelledCtx, client, "key", fetchFn); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled call to return context.Canceled, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(releaseFetch)
+	wg.Wait()
+	close(sources)
+
+	counts := make(map[sturdyc.Source]int)
+	for source := range sources {
+		counts[source]++
+	}
+	if counts[sturdyc.SourceFetch] != 1 || counts[sturdyc.SourceCoalesced] != numGoroutines-1 {
+		t.Errorf("expected 1 fetch and %d coalesced calls, got %v", numGoroutines-1, counts)
+	}
+	if coalesced := client.Stats().CoalescedFetches; coalesced != uint64(numGoroutines-1) {
+		t.Errorf("expected the stats to count %d coalesced fetches, got %d", numGoroutines-1, coalesced)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fetchCount != 1 {
+		t.Errorf("expected 1 fetch, got %d", fetchCount)
+	}
+}
+
+func TestWaitersRetryWhenTheFetchingCallerIsCancelled(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(10, 1, time.Hour, 10)
+
+	fetchStarted := make(chan struct{})
+	firstCtx, cancel := context.WithCancel(context.Background())
+	firstDone := make(chan error)
+	go func() {
+		_, err := sturdyc.GetFetch(firstCtx, client, "key", func(ctx context.Context) (string, error) {
+			close(fetchStarted)
+			<-ctx.Done()
+			return "", ctx.Err()
+		})
+		firstDone <- err
+	}()
+	<-fetchStarted
+
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		res, err := sturdyc.GetFetch(context.Background(), client, "key", func(_ context.Context) (string, error) {
+			return "value", nil
+		})
+		if err != nil || res != "value" {
+			t.Errorf("expected the waiter to fetch the value itself, got %q (err: %v)", res, err)
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-firstDone; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled caller to return context.Canceled, got %v", err)
+	}
+	<-waiterDone
+}
+
+func TestConcurrentRevalidatingFetchesOfAKeyAreCoalesced(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(10, 1, time.Hour, 10)
+
+	var fetchCount atomic.Int32
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	revalidateFn := func(_ context.Context, _ string, _ string) (string, string, error) {
+		fetchCount.Add(1)
+		close(fetchStarted)
+		<-releaseFetch
+		return "value", "v1", nil
+	}
+
+	numGoroutines := 10
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func() {
+			defer wg.Done()
+			res, err := sturdyc.GetFetchRevalidate(ctx, client, "key", revalidateFn)
+			if err != nil || res != "value" {
+				t.Errorf("expected the fetched value, got %q (err: %v)", res, err)
+			}
+		}()
+		// Make sure that the first goroutine is the one performing the fetch.
+		if i == 0 {
+			<-fetchStarted
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(releaseFetch)
+	wg.Wait()
+
+	if count := fetchCount.Load(); count != 1 {
+		t.Errorf("expected 1 fetch, got %d", count)
+	}
+}
+func TestGetFetchBatchWithMetaDescribesTheSources(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(10, 1, time.Hour, 10, sturdyc.WithClock(clock))
+	keyFn := client.BatchKeyFn("item")
+	fetchFn := func(_ context.Context, ids []string) (map[string]string, error) {
+		response := make(map[string]string, len(ids))
+		for _, id := range ids {
+			response[id] = "value" + id
+		}
+		return response, nil
+	}
+
+	if _, err := sturdyc.GetFetchBatch(ctx, client, []string{"1"}, keyFn, fetchFn); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Add(time.Minute)
+	res, metas, err := sturdyc.GetFetchBatchWithMeta(ctx, client, []string{"1", "2"}, keyFn, fetchFn)
+	if err != nil || len(res) != 2 {
+		t.Fatalf("expected 2 records, got %v (err: %v)", res, err)
+	}
+
+	want := map[string]sturdyc.ResultMeta{
+		"1": {Source: sturdyc.SourceCache, Age: time.Minute},
+		"2": {Source: sturdyc.SourceFetch, Age: 0},
+	}
+	if !cmp.Equal(want, metas) {
+		t.Error(cmp.Diff(want, metas))
+	}
+}
+
+func TestRangeKeysAndScan(t *testing.T) {
+	t.Parallel()
+
+	clock := sturdyc.NewTestClock(time.Now())
+	ttl := time.Hour
+	metricsRecorder := newTestMetricsRecorder(4)
+	client := sturdyc.New(100, 4, ttl, 10, sturdyc.WithClock(clock), sturdyc.WithMetrics(metricsRecorder))
+	sturdyc.Set(client, "expired", 0)
+	clock.Add(ttl / 2)
+	sturdyc.Set(client, "user-1", 1)
+	sturdyc.Set(client, "user-2", 2)
+	sturdyc.Set(client, "user-3", "three")
+	sturdyc.Set(client, "order-1", 1)
+	clock.Add(ttl/2 + time.Second)
+
+	ranged := make(map[string]any)
+	client.Range(func(key string, value any, info sturdyc.EntryInfo) bool {
+		if info.Age != ttl/2+time.Second {
+			t.Errorf("expected the age of %s to be %v, got %v", key, ttl/2+time.Second, info.Age)
+		}
+		ranged[key] = value
+		return true
+	})
+	wantRanged := map[string]any{"user-1": 1, "user-2": 2, "user-3": "three", "order-1": 1}
+	if !cmp.Equal(wantRanged, ranged) {
+		t.Error(cmp.Diff(wantRanged, ranged))
+	}
+
+	var visited int
+	client.Range(func(_ string, _ any, _ sturdyc.EntryInfo) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("expected the iteration to stop after 1 entry, got %d", visited)
+	}
+
+	wantKeys := []string{"user-1", "user-2", "user-3"}
+	if keys := client.Keys("user-"); !cmp.Equal(wantKeys, keys) {
+		t.Error(cmp.Diff(wantKeys, keys))
+	}
+
+	scanned := make(map[string]int)
+	sturdyc.Scan(client, "user-", func(key string, value int, _ sturdyc.EntryInfo) bool {
+		scanned[key] = value
+		return true
+	})
+	wantScanned := map[string]int{"user-1": 1, "user-2": 2}
+	if !cmp.Equal(wantScanned, scanned) {
+		t.Error(cmp.Diff(wantScanned, scanned))
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.cacheHits != 0 {
+		t.Errorf("expected iterating to not record any cache hits, got %d", metricsRecorder.cacheHits)
+	}
+}
+
+func TestDeleteMatchingAndDeleteFunc(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	reasons := make(map[sturdyc.EvictionReason]int)
+	hook := func(_ string, _ any, reason sturdyc.EvictionReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[reason]++
+	}
+	metricsRecorder := newTestMetricsRecorder(4)
+	client := sturdyc.New(1000, 4, time.Hour, 10,
+		sturdyc.WithEvictionHook(hook),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+
+	// Write enough entries to make the deletions span multiple chunks.
+	numEntries := 250
+	for i := 0; i < numEntries; i++ {
+		sturdyc.Set(client, "carrier-dhl-"+strconv.Itoa(i), i)
+		sturdyc.Set(client, "carrier-ups-"+strconv.Itoa(i), i)
+	}
+
+	deleted := client.DeleteMatching("carrier-dhl-*")
+	if deleted != numEntries {
+		t.Fatalf("expected %d entries to be deleted, got %d", numEntries, deleted)
+	}
+	if keys := client.Keys("carrier-dhl-"); len(keys) != 0 {
+		t.Errorf("expected every dhl entry to be deleted, got %v", keys)
+	}
+
+	deleted = client.DeleteFunc(func(_ string, value any) bool {
+		v, ok := value.(int)
+		return ok && v%2 == 0
+	})
+	if deleted != numEntries/2 || client.Size() != numEntries/2 {
+		t.Errorf("expected %d entries to be deleted and remain, got %d and %d", numEntries/2, deleted, client.Size())
+	}
+
+	mu.Lock()
+	if reasons[sturdyc.EvictionDeleted] != numEntries+numEntries/2 {
+		t.Errorf("expected the hook to be called for %d deleted entries, got %v", numEntries+numEntries/2, reasons)
+	}
+	mu.Unlock()
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.evictedEntries != numEntries+numEntries/2 {
+		t.Errorf("expected %d evicted entries, got %d", numEntries+numEntries/2, metricsRecorder.evictedEntries)
+	}
+}
+
+func TestDeleteMatchingTreatsSlashesAndBackslashesLiterally(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 4, time.Hour, 10)
+	keys := []string{
+		"shipments-DHL/express-ID-1",
+		"shipments-DHL-ID-2",
+		`tenant\-1-g0-key`,
+		`tenant\-1-g0-other`,
+		"tenant-10-g0-key",
+		"shipments-å-ID-3",
+	}
+	for _, key := range keys {
+		sturdyc.Set(client, key, "value")
+	}
+
+	testCases := []struct {
+		pattern string
+		deleted []string
+	}{
+		{pattern: "shipments-DHL*", deleted: []string{"shipments-DHL/express-ID-1", "shipments-DHL-ID-2"}},
+		{pattern: `tenant\-1-*`, deleted: []string{`tenant\-1-g0-key`, `tenant\-1-g0-other`}},
+		{pattern: "tenant-?0-*", deleted: []string{"tenant-10-g0-key"}},
+		{pattern: "shipments-?-ID-*", deleted: []string{"shipments-å-ID-3"}},
+		{pattern: "shipments-DHL", deleted: []string{}},
+	}
+	for _, tc := range testCases {
+		remaining := client.Keys("")
+		if deleted := client.DeleteMatching(tc.pattern); deleted != len(tc.deleted) {
+			t.Errorf("expected %q to delete %d entries, got %d", tc.pattern, len(tc.deleted), deleted)
+		}
+		for _, key := range tc.deleted {
+			if _, ok := sturdyc.Get[string](client, key); ok {
+				t.Errorf("expected %q to delete %s", tc.pattern, key)
+			}
+		}
+		if len(remaining)-len(tc.deleted) != client.Size() {
+			t.Errorf("expected %q to only delete %v, got %d entries left", tc.pattern, tc.deleted, client.Size())
+		}
+	}
+}
+
+func TestEvictionHookReportsForcedEvictions(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	reasons := make(map[sturdyc.EvictionReason]int)
+	hook := func(_ string, _ any, reason sturdyc.EvictionReason) {
+		mu.Lock()
+		defer mu.Unlock()
+		reasons[reason]++
+	}
+	capacity := 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, 1, time.Hour, 50, sturdyc.WithEvictionHook(hook), sturdyc.WithClock(clock))
+	for i := 0; i <= capacity; i++ {
+		sturdyc.Set(client, strconv.Itoa(i), i)
+		clock.Add(time.Second)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if reasons[sturdyc.EvictionCapacity] == 0 {
+		t.Errorf("expected the hook to be called for evictions caused by the capacity, got %v", reasons)
+	}
+}
+
+func TestBumpNamespaceInvalidatesItsEntries(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(100, 4, time.Hour, 10)
+
+	var mu sync.Mutex
+	var fetchCount int
+	fetchFn := func(_ context.Context) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetchCount++
+		return "value" + strconv.Itoa(fetchCount), nil
+	}
+	getFetch := func(namespace string) string {
+		t.Helper()
+		res, err := sturdyc.GetFetch(ctx, client, client.NamespacedKey(namespace, "key"), fetchFn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	previousPrefix := client.NamespacePrefix("tenant-1")
+	if res := getFetch("tenant-1"); res != "value1" {
+		t.Errorf("expected value1, got %q", res)
+	}
+	if res := getFetch("tenant-2"); res != "value2" {
+		t.Errorf("expected value2, got %q", res)
+	}
+
+	if generation := client.BumpNamespace("tenant-1"); generation != 1 {
+		t.Errorf("expected the namespace to be at generation 1, got %d", generation)
+	}
+	bumpedPrefix := client.NamespacePrefix("tenant-1")
+	if res := getFetch("tenant-1"); res != "value3" {
+		t.Errorf("expected the bumped namespace to be fetched again, got %q", res)
+	}
+	if res := getFetch("tenant-2"); res != "value2" {
+		t.Errorf("expected the other namespace to be unaffected, got %q", res)
+	}
+
+	// Fetches that are in flight while the namespace is bumped are written to
+	// the keys of the previous generation, while other keys are unaffected.
+	var wg sync.WaitGroup
+	releaseFetch := make(chan struct{})
+	for _, key := range []string{client.NamespacedKey("tenant-1", "other"), "unrelated-key"} {
+		fetchStarted := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sturdyc.GetFetch(ctx, client, key, func(_ context.Context) (string, error) {
+				close(fetchStarted)
+				<-releaseFetch
+				return "fetched", nil
+			})
+		}()
+		<-fetchStarted
+	}
+	client.BumpNamespace("tenant-1")
+	close(releaseFetch)
+	wg.Wait()
+
+	if _, ok := sturdyc.Get[string](client, "unrelated-key"); !ok {
+		t.Error("expected the fetch of the unrelated key to be cached")
+	}
+	if _, ok := sturdyc.Get[string](client, client.NamespacedKey("tenant-1", "other")); ok {
+		t.Error("expected the fetch of the previous generation to be unreachable")
+	}
+
+	// The entries of the previous generations are left to expire, unless
+	// they're deleted by their prefix.
+	if keys := client.Keys(client.NamespacePrefix("tenant-1")); len(keys) != 0 {
+		t.Errorf("expected the current generation to be empty, got %v", keys)
+	}
+	want := []string{bumpedPrefix + "key", bumpedPrefix + "other"}
+	if keys := client.Keys(bumpedPrefix); !cmp.Equal(want, keys) {
+		t.Error(cmp.Diff(want, keys))
+	}
+	if keys := client.Keys(previousPrefix); !cmp.Equal([]string{previousPrefix + "key"}, keys) {
+		t.Errorf("expected the entry of the first generation to remain, got %v", keys)
+	}
+	if deleted := client.DeleteMatching(previousPrefix + "*"); deleted != 1 {
+		t.Errorf("expected the entry of the first generation to be deleted, got %d deletions", deleted)
+	}
+	if keys := client.Keys(bumpedPrefix); !cmp.Equal(want, keys) {
+		t.Error(cmp.Diff(want, keys))
+	}
+}
+
+func TestBumpNamespaceDropsBatchesThatAreInFlight(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(100, 4, time.Hour, 10,
+		sturdyc.WithStampedeProtection(time.Minute, time.Minute*2, time.Second, true),
+		sturdyc.WithClock(clock),
+	)
+	keyFn := client.NamespacedKeyFn("tenant", client.BatchKeyFn("item"))
+
+	fetchStarted := make(chan struct{})
+	releaseFetch := make(chan struct{})
+	fetchFn := func(_ context.Context, ids []string) (map[string]string, error) {
+		fetchStarted <- struct{}{}
+		<-releaseFetch
+		response := make(map[string]string, len(ids))
+		for _, id := range ids {
+			response[id] = "stale"
+		}
+		return response, nil
+	}
+
+	// A fetch that is in flight while the namespace is bumped.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sturdyc.GetFetchBatch(ctx, client, []string{"1"}, keyFn, fetchFn)
+	}()
+	<-fetchStarted
+	client.BumpNamespace("tenant")
+	releaseFetch <- struct{}{}
+	<-done
+
+	if _, ok := sturdyc.Get[string](client, keyFn.Key("1")); ok {
+		t.Error("expected the fetch of the previous generation to be unreachable")
+	}
+
+	// A refresh that is in flight while the namespace is bumped.
+	go sturdyc.GetFetchBatch(ctx, client, []string{"2"}, keyFn, fetchFn)
+	<-fetchStarted
+	releaseFetch <- struct{}{}
+	clock.Add(time.Minute * 3)
+	waitForRefresh := make(chan struct{})
+	go func() {
+		defer close(waitForRefresh)
+		<-fetchStarted
+		client.BumpNamespace("tenant")
+		releaseFetch <- struct{}{}
+	}()
+	if _, err := sturdyc.GetFetchBatch(ctx, client, []string{"2"}, keyFn, fetchFn); err != nil {
+		t.Fatal(err)
+	}
+	<-waitForRefresh
+	time.Sleep(10 * time.Millisecond)
+
+	if _, ok := sturdyc.Get[string](client, keyFn.Key("2")); ok {
+		t.Error("expected the refresh of the previous generation to be unreachable")
+	}
+	want := []string{`tenant-g0-item-ID-1`, `tenant-g1-item-ID-2`}
+	if keys := client.Keys("tenant-"); !cmp.Equal(want, keys) {
+		t.Error(cmp.Diff(want, keys))
+	}
+}
+
+func TestGetFetchBatchOrderedDeduplicatesAndPreservesTheOrder(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	client := sturdyc.New(100, 1, time.Hour, 5,
+		sturdyc.WithStampedeProtection(time.Minute, time.Minute*2, time.Second, true),
+		sturdyc.WithClock(sturdyc.NewTestClock(time.Now())),
+	)
+	keyFn := client.BatchKeyFn("item")
+
+	var requested [][]string
+	fetchErr := errors.New("upstream unavailable")
+	fetchFn := func(_ context.Context, ids []string) (map[string]int, error) {
+		requested = append(requested, ids)
+		if len(requested) > 1 {
+			return nil, fetchErr
+		}
+		return map[string]int{"1": 1, "2": 2}, nil
+	}
+
+	results, err := sturdyc.GetFetchBatchOrdered(ctx, client, []string{"1", "2", "1", "3"}, keyFn, fetchFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sturdyc.BatchResult[int]{
+		{ID: "1", Value: 1, Status: sturdyc.BatchFound, Err: nil},
+		{ID: "2", Value: 2, Status: sturdyc.BatchFound, Err: nil},
+		{ID: "1", Value: 1, Status: sturdyc.BatchFound, Err: nil},
+		{ID: "3", Value: 0, Status: sturdyc.BatchMissing, Err: nil},
+	}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Errorf("unexpected results (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([][]string{{"1", "2", "3"}}, requested); diff != "" {
+		t.Errorf("expected the duplicated ID to be fetched once (-want +got):\n%s", diff)
+	}
+
+	// The record that is missing stays missing, even though the fetch fails.
+	results, err = sturdyc.GetFetchBatchOrdered(ctx, client, []string{"4", "3", "1", "4"}, keyFn, fetchFn)
+	if !errors.Is(err, sturdyc.ErrOnlyCachedRecords) || !errors.Is(err, fetchErr) {
+		t.Errorf("expected ErrOnlyCachedRecords wrapping the error of the fetch, got %v", err)
+	}
+	statuses := make([]sturdyc.BatchStatus, 0, len(results))
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+		if result.Status == sturdyc.BatchErrored && !errors.Is(result.Err, fetchErr) {
+			t.Errorf("expected ID %s to have the error of the fetch, got %v", result.ID, result.Err)
+		}
+		if result.Status != sturdyc.BatchErrored && result.Err != nil {
+			t.Errorf("expected ID %s to not have an error, got %v", result.ID, result.Err)
+		}
+	}
+	wantStatuses := []sturdyc.BatchStatus{
+		sturdyc.BatchErrored, sturdyc.BatchMissing, sturdyc.BatchFound, sturdyc.BatchErrored,
+	}
+	if diff := cmp.Diff(wantStatuses, statuses); diff != "" {
+		t.Errorf("unexpected statuses (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"4"}, requested[1]); diff != "" {
+		t.Errorf("expected only the uncached ID to be fetched (-want +got):\n%s", diff)
+	}
+}
+
+func TestStatsAreKeptWithoutAMetricsRecorder(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	minRefreshDelay := time.Minute
+	maxRefreshDelay := time.Minute * 2
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(100, 2, time.Hour, 5,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, time.Second, false),
+		sturdyc.WithClock(clock),
+	)
+
+	refreshed := make(chan struct{}, 1)
+	var fetches int
+	fetchFn := func(_ context.Context) (string, error) {
+		fetches++
+		if fetches > 1 {
+			defer func() { refreshed <- struct{}{} }()
+			return "", errors.New("upstream unavailable")
+		}
+		return "value", nil
+	}
+
+	sturdyc.GetFetch(ctx, client, "key1", fetchFn)
+	sturdyc.Set(client, "key2", "value")
+	sturdyc.Get[string](client, "key2")
+	sturdyc.Get[string](client, "key3")
+	sturdyc.Delete(client, "key2")
+
+	// The next call is going to schedule a refresh, which fails.
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetch(ctx, client, "key1", fetchFn)
+	<-refreshed
+	for i := 0; i < 100 && client.Stats().Refreshes == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	stats := client.Stats()
+	want := sturdyc.Stats{
+		Hits:             2,
+		Misses:           2,
+		Evictions:        1,
+		ForcedEvictions:  0,
+		Refreshes:        1,
+		RefreshErrors:    1,
+		CoalescedFetches: 0,
+		BufferedBatches:  0,
+		ShardSizes:       stats.ShardSizes,
+	}
+	if diff := cmp.Diff(want, stats); diff != "" {
+		t.Errorf("unexpected stats (-want +got):\n%s", diff)
+	}
+	if len(stats.ShardSizes) != 2 || stats.ShardSizes[0]+stats.ShardSizes[1] != client.Size() {
+		t.Errorf("expected the shard sizes to add up to %d, got %v", client.Size(), stats.ShardSizes)
+	}
+
+	client.ResetStats()
+	if diff := cmp.Diff(sturdyc.Stats{ShardSizes: stats.ShardSizes}, client.Stats()); diff != "" {
+		t.Errorf("expected the counters to be reset (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,325 @@
+// Command sturdyc-keygen generates CacheKey methods for permutation structs.
+// The methods produce the same keys as PermutatedKey, which uses them instead
+// of reflection when they're available. It's meant to be used with go generate:
+//
+//	//go:generate go run github.com/creativecreature/sturdyc/cmd/sturdyc-keygen -type=Options
+//
+// The types have to be declared in the file that contains the directive, and
+// the methods are written to a file with the same name and a _sturdyc suffix.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("sturdyc-keygen: ")
+
+	typeNames := flag.String("type", "", "comma-separated list of struct types to generate CacheKey methods for")
+	file := flag.String("file", os.Getenv("GOFILE"), "the file that declares the types")
+	output := flag.String("output", "", "the file to write the methods to")
+	flag.Parse()
+
+	if *typeNames == "" || *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := generate(*file, strings.Split(*typeNames, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		*output = outputFile(*file)
+	}
+	//nolint:gosec // The generated file is meant to be readable, just like the source files.
+	if err := os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// outputFile returns the name of the generated file. Files generated from
+// test files are test files as well.
+func outputFile(file string) string {
+	if base, ok := strings.CutSuffix(file, "_test.go"); ok {
+		return base + "_sturdyc_test.go"
+	}
+	return strings.TrimSuffix(file, ".go") + "_sturdyc.go"
+}
+
+// keyField is a field of a permutation struct that is written to the key.
+type keyField struct {
+	name       string
+	access     string
+	expr       ast.Expr
+	truncation time.Duration
+}
+
+func generate(file string, typeNames []string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, file, nil, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by sturdyc-keygen. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package %s\n\n", f.Name.Name)
+	fmt.Fprintf(&buf, "import \"github.com/creativecreature/sturdyc\"\n")
+
+	timePackage := importName(f, "time")
+	for _, typeName := range typeNames {
+		structType, err := findStruct(f, typeName)
+		if err != nil {
+			return nil, err
+		}
+
+		receiver := strings.ToLower(typeName[:1])
+		if receiver == "w" {
+			receiver = "v"
+		}
+		fields, err := keyFields(structType, receiver, timePackage)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", typeName, err)
+		}
+
+		fmt.Fprintf(&buf, "\n// CacheKey writes the fields of %s to the key. It's used by sturdyc.PermutatedKey.\n", typeName)
+		fmt.Fprintf(&buf, "func (%s %s) CacheKey(w *sturdyc.KeyWriter) {\n", receiver, typeName)
+		for _, field := range fields {
+			fmt.Fprintf(&buf, "w.Field(%q)\n", field.name)
+			buf.WriteString(writeStatement(field.expr, field.access, field.truncation, timePackage))
+		}
+		buf.WriteString("}\n")
+	}
+
+	return format.Source(buf.Bytes())
+}
+
+// importName returns the name that the file uses for the package, or an empty string if it isn't imported.
+func importName(f *ast.File, path string) string {
+	for _, spec := range f.Imports {
+		importPath, err := strconv.Unquote(spec.Path.Value)
+		if err != nil || importPath != path {
+			continue
+		}
+		if spec.Name != nil {
+			return spec.Name.Name
+		}
+		return path[strings.LastIndex(path, "/")+1:]
+	}
+	return ""
+}
+
+func findStruct(f *ast.File, typeName string) (*ast.StructType, error) {
+	for _, decl := range f.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range genDecl.Specs {
+			typeSpec, ok := spec.(*ast.TypeSpec)
+			if !ok || typeSpec.Name.Name != typeName {
+				continue
+			}
+			if typeSpec.TypeParams != nil {
+				return nil, fmt.Errorf("%s: generic types are not supported", typeName)
+			}
+			structType, ok := typeSpec.Type.(*ast.StructType)
+			if !ok {
+				return nil, fmt.Errorf("%s is not a struct", typeName)
+			}
+			return structType, nil
+		}
+	}
+	return nil, fmt.Errorf("type %s is not declared in the file", typeName)
+}
+
+// keyFields returns the fields in the order that PermutatedKey writes them:
+// the unnamed fields in the order that they're declared, followed by the
+// named fields sorted by their name.
+func keyFields(structType *ast.StructType, receiver, timePackage string) ([]keyField, error) {
+	unnamed := make([]keyField, 0)
+	named := make([]keyField, 0)
+	names := make(map[string]struct{})
+	for _, field := range structType.Fields.List {
+		var tag string
+		if field.Tag != nil {
+			rawTag, err := strconv.Unquote(field.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(rawTag).Get("sturdyc")
+		}
+		if tag == "-" {
+			continue
+		}
+
+		declaredNames, err := fieldNames(field)
+		if err != nil {
+			return nil, err
+		}
+		for _, fieldName := range declaredNames {
+			if !ast.IsExported(fieldName) {
+				continue
+			}
+
+			keyField := keyField{name: "", access: receiver + "." + fieldName, expr: field.Type, truncation: 0}
+			if err := parseTag(&keyField, fieldName, tag, names, timePackage); err != nil {
+				return nil, err
+			}
+			if keyField.name != "" {
+				named = append(named, keyField)
+				continue
+			}
+			unnamed = append(unnamed, keyField)
+		}
+	}
+
+	sort.Slice(named, func(i, j int) bool {
+		return named[i].name < named[j].name
+	})
+	return append(unnamed, named...), nil
+}
+
+// fieldNames returns the names of the field, which is the name of the type for
+// embedded fields. The type arguments of embedded generic types are ignored,
+// just like they are by the field names of the reflect package.
+func fieldNames(field *ast.Field) ([]string, error) {
+	if len(field.Names) > 0 {
+		names := make([]string, 0, len(field.Names))
+		for _, name := range field.Names {
+			names = append(names, name.Name)
+		}
+		return names, nil
+	}
+
+	expr := field.Type
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	switch t := expr.(type) {
+	case *ast.IndexExpr:
+		expr = t.X
+	case *ast.IndexListExpr:
+		expr = t.X
+	}
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return []string{t.Name}, nil
+	case *ast.SelectorExpr:
+		return []string{t.Sel.Name}, nil
+	default:
+		return nil, fmt.Errorf("embedded field of type %s is not supported", types.ExprString(field.Type))
+	}
+}
+
+// parseTag applies the options of the sturdyc tag, which are validated the same way as by PermutatedKey.
+func parseTag(field *keyField, fieldName, tag string, names map[string]struct{}, timePackage string) error {
+	for _, option := range strings.Split(tag, ",") {
+		if option == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "name":
+			if value == "" || strings.ContainsAny(value, `-,=\`) {
+				return fmt.Errorf("sturdyc tag of field %s has an invalid name %q", fieldName, value)
+			}
+			if _, ok := names[value]; ok {
+				return fmt.Errorf("sturdyc tag of field %s reuses the name %q", fieldName, value)
+			}
+			names[value] = struct{}{}
+			field.name = value
+		case "truncate":
+			truncation, err := time.ParseDuration(value)
+			if err != nil || truncation <= 0 {
+				return fmt.Errorf("sturdyc tag of field %s has an invalid truncation %q", fieldName, value)
+			}
+			if !isTimeType(field.expr, timePackage) {
+				return fmt.Errorf("sturdyc tag of field %s can only truncate time.Time values", fieldName)
+			}
+			field.truncation = truncation
+		default:
+			return fmt.Errorf("sturdyc tag of field %s has an unknown option %q", fieldName, option)
+		}
+	}
+	return nil
+}
+
+// isTimeType reports whether the type is a time.Time, or a pointer to one.
+func isTimeType(expr ast.Expr, timePackage string) bool {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		expr = star.X
+	}
+	selector, ok := expr.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	return ok && timePackage != "" && pkg.Name == timePackage && selector.Sel.Name == "Time"
+}
+
+var errNotWritable = errors.New("the type has to be written with reflection")
+
+// writeStatement returns the statement that writes the field. Types without a
+// dedicated method on the KeyWriter fall back to KeyWriter.FieldValue, which
+// writes the fields of interface types the same way as PermutatedKey.
+func writeStatement(expr ast.Expr, access string, truncation time.Duration, timePackage string) string {
+	if star, ok := expr.(*ast.StarExpr); ok {
+		stmt, err := directWrite(star.X, "*"+access, truncation, timePackage)
+		if err == nil {
+			return fmt.Sprintf("if %s == nil {\nw.Nil()\n} else {\n%s}\n", access, stmt)
+		}
+	}
+
+	stmt, err := directWrite(expr, access, truncation, timePackage)
+	if err != nil {
+		return fmt.Sprintf("w.FieldValue(&%s)\n", access)
+	}
+	return stmt
+}
+
+func directWrite(expr ast.Expr, access string, truncation time.Duration, timePackage string) (string, error) {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		switch t.Name {
+		case "string":
+			return fmt.Sprintf("w.String(%s)\n", access), nil
+		case "bool":
+			return fmt.Sprintf("w.Bool(%s)\n", access), nil
+		case "int", "int8", "int16", "int32", "int64":
+			return fmt.Sprintf("w.Int(int64(%s))\n", access), nil
+		case "uint", "uint8", "uint16", "uint32", "uint64":
+			return fmt.Sprintf("w.Uint(uint64(%s))\n", access), nil
+		}
+	case *ast.SelectorExpr:
+		if isTimeType(t, timePackage) {
+			if truncation == 0 {
+				return fmt.Sprintf("w.Time(%s, 0)\n", access), nil
+			}
+			return fmt.Sprintf("w.Time(%s, %d) // %s\n", access, truncation.Nanoseconds(), truncation), nil
+		}
+	case *ast.ArrayType:
+		if elem, ok := t.Elt.(*ast.Ident); ok && t.Len == nil && elem.Name == "string" {
+			return fmt.Sprintf("w.Strings(%s)\n", access), nil
+		}
+	}
+	return "", errNotWritable
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"go/ast"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// generateSource writes the source to a file, and generates the CacheKey methods of the types.
+func generateSource(t *testing.T, src string, typeNames ...string) (string, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "params.go")
+	if err := os.WriteFile(file, []byte(src), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := generate(file, typeNames)
+	return string(out), err
+}
+
+func TestGenerate(t *testing.T) {
+	t.Parallel()
+
+	src := `package params
+
+import (
+	stdtime "time"
+
+	"example.com/pagination"
+)
+
+type Inner[T any] struct {
+	Value T
+}
+
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+type Params struct {
+	Inner[int]
+	*Pair[string, int]
+	pagination.Cursor
+	Query    string
+	Page     int
+	Tags     []string
+	Since    *stdtime.Time
+	Day      stdtime.Time ` + "`sturdyc:\"name=day,truncate=24h\"`" + `
+	Filters  map[string]int
+	Extra    any
+	internal string
+	Debug    bool ` + "`sturdyc:\"-\"`" + `
+}
+
+type Window struct {
+	Width int
+}
+`
+	got, err := generateSource(t, src, "Params", "Window")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `// Code generated by sturdyc-keygen. DO NOT EDIT.
+
+package params
+
+import "github.com/creativecreature/sturdyc"
+
+// CacheKey writes the fields of Params to the key. It's used by sturdyc.PermutatedKey.
+func (p Params) CacheKey(w *sturdyc.KeyWriter) {
+	w.Field("")
+	w.FieldValue(&p.Inner)
+	w.Field("")
+	w.FieldValue(&p.Pair)
+	w.Field("")
+	w.FieldValue(&p.Cursor)
+	w.Field("")
+	w.String(p.Query)
+	w.Field("")
+	w.Int(int64(p.Page))
+	w.Field("")
+	w.Strings(p.Tags)
+	w.Field("")
+	if p.Since == nil {
+		w.Nil()
+	} else {
+		w.Time(*p.Since, 0)
+	}
+	w.Field("")
+	w.FieldValue(&p.Filters)
+	w.Field("")
+	w.FieldValue(&p.Extra)
+	w.Field("day")
+	w.Time(p.Day, 86400000000000) // 24h0m0s
+}
+
+// CacheKey writes the fields of Window to the key. It's used by sturdyc.PermutatedKey.
+func (v Window) CacheKey(w *sturdyc.KeyWriter) {
+	w.Field("")
+	w.Int(int64(v.Width))
+}
+`
+	if got != want {
+		t.Errorf("got:\n%s\nwanted:\n%s", got, want)
+	}
+}
+
+func TestGenerateRejectsInvalidStructs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		src      string
+		typeName string
+		wantErr  string
+	}{
+		{
+			name:     "truncate on a field that isn't a time",
+			src:      "type Params struct {\n\tDay string `sturdyc:\"truncate=24h\"`\n}",
+			typeName: "Params",
+			wantErr:  "sturdyc tag of field Day can only truncate time.Time values",
+		},
+		{
+			name:     "truncate on a time of a package that isn't imported",
+			src:      "type Params struct {\n\tDay time.Time `sturdyc:\"truncate=24h\"`\n}",
+			typeName: "Params",
+			wantErr:  "sturdyc tag of field Day can only truncate time.Time values",
+		},
+		{
+			name:     "invalid truncation",
+			src:      "import \"time\"\n\ntype Params struct {\n\tDay time.Time `sturdyc:\"truncate=daily\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field Day has an invalid truncation "daily"`,
+		},
+		{
+			name:     "negative truncation",
+			src:      "import \"time\"\n\ntype Params struct {\n\tDay time.Time `sturdyc:\"truncate=-1h\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field Day has an invalid truncation "-1h"`,
+		},
+		{
+			name:     "invalid name",
+			src:      "type Params struct {\n\tQuery string `sturdyc:\"name=a-b\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field Query has an invalid name "a-b"`,
+		},
+		{
+			name:     "empty name",
+			src:      "type Params struct {\n\tQuery string `sturdyc:\"name=\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field Query has an invalid name ""`,
+		},
+		{
+			name:     "reused name",
+			src:      "type Params struct {\n\tA string `sturdyc:\"name=q\"`\n\tB string `sturdyc:\"name=q\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field B reuses the name "q"`,
+		},
+		{
+			name:     "unknown option",
+			src:      "type Params struct {\n\tQuery string `sturdyc:\"omitempty\"`\n}",
+			typeName: "Params",
+			wantErr:  `sturdyc tag of field Query has an unknown option "omitempty"`,
+		},
+		{
+			name:     "generic type",
+			src:      "type Params[T any] struct {\n\tValue T\n}",
+			typeName: "Params",
+			wantErr:  "Params: generic types are not supported",
+		},
+		{
+			name:     "type that isn't a struct",
+			src:      "type Params map[string]string",
+			typeName: "Params",
+			wantErr:  "Params is not a struct",
+		},
+		{
+			name:     "source that doesn't parse",
+			src:      "type Params struct {",
+			typeName: "Params",
+			wantErr:  "expected",
+		},
+		{
+			name:     "type that isn't declared",
+			src:      "type Options struct{}",
+			typeName: "Params",
+			wantErr:  "type Params is not declared in the file",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := generateSource(t, "package params\n\n"+tc.src+"\n", tc.typeName)
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("expected an error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestFieldNames(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		expr    ast.Expr
+		want    []string
+		wantErr bool
+	}{
+		{name: "type", expr: ast.NewIdent("Inner"), want: []string{"Inner"}, wantErr: false},
+		{
+			name:    "pointer to a type of another package",
+			expr:    &ast.StarExpr{X: &ast.SelectorExpr{X: ast.NewIdent("pagination"), Sel: ast.NewIdent("Cursor")}},
+			want:    []string{"Cursor"},
+			wantErr: false,
+		},
+		{
+			name:    "generic type",
+			expr:    &ast.IndexExpr{X: ast.NewIdent("Inner"), Index: ast.NewIdent("int")},
+			want:    []string{"Inner"},
+			wantErr: false,
+		},
+		{
+			name: "pointer to a generic type with several type arguments",
+			expr: &ast.StarExpr{X: &ast.IndexListExpr{
+				X:       ast.NewIdent("Pair"),
+				Indices: []ast.Expr{ast.NewIdent("string"), ast.NewIdent("int")},
+			}},
+			want:    []string{"Pair"},
+			wantErr: false,
+		},
+		// The parser rejects these, but they should never be skipped silently.
+		{name: "slice", expr: &ast.ArrayType{Elt: ast.NewIdent("int")}, want: nil, wantErr: true},
+		{name: "map", expr: &ast.MapType{Key: ast.NewIdent("string"), Value: ast.NewIdent("int")}, want: nil, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			got, err := fieldNames(&ast.Field{Type: tc.expr})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected an error: %t, got %v", tc.wantErr, err)
+			}
+			if !slices.Equal(got, tc.want) {
+				t.Errorf("got: %v wanted: %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	t.Parallel()
+
+	testCases := map[string]string{
+		"params.go":      "params_sturdyc.go",
+		"params_test.go": "params_sturdyc_test.go",
+	}
+	for file, want := range testCases {
+		if got := outputFile(file); got != want {
+			t.Errorf("got: %s wanted: %s", got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package sturdyc
+
+// ComputeAction is returned by the function passed to Compute, and
+// determines what should happen to the entry once it returns.
+type ComputeAction int
+
+const (
+	// ComputeKeep leaves the cache untouched.
+	ComputeKeep ComputeAction = iota
+	// ComputeStore writes the returned value to the cache.
+	ComputeStore
+	// ComputeDelete removes the key from the cache.
+	ComputeDelete
+)
+
+// Compute calls fn with the value that is currently cached for the key, and
+// performs the returned action while holding the lock of the shard. This
+// allows values to be updated without losing writes from other goroutines.
+// The exists argument is false if the key has no entry, or if its entry has
+// expired. Missing records, and values of another type, exist, but are passed
+// to fn as the zero value of T.
+//
+// Returns the value of the key after the action has been performed, and a
+// boolean that is true if the key exists. The function must not call any
+// other methods on the client, as it would deadlock on the lock of the shard.
+func Compute[T any](c *Client, key string, fn func(old T, exists bool) (T, ComputeAction)) (T, bool) {
+	return compute(c, key, func(old T, _, exists bool) (T, ComputeAction) {
+		return fn(old, exists)
+	})
+}
+
+// compute works like Compute, and tells fn whether the entry holds a value of
+// type T, which is false for missing records and values of other types.
+func compute[T any](c *Client, key string, fn func(old T, isValue, exists bool) (T, ComputeAction)) (T, bool) {
+	shard := c.getShard(key)
+	value, exists := shard.compute(key, func(old any, exists, isMissingRecord bool) (any, ComputeAction) {
+		oldValue, isValue := asValue[T](old)
+		return fn(oldValue, exists && !isMissingRecord && isValue, exists)
+	})
+
+	if !exists {
+		var zero T
+		return zero, false
+	}
+	val, _ := asValue[T](value)
+	return val, true
+}
+
+// asValue converts the cached value to T. A nil value is
+// only a T if T is an interface type, such as any.
+func asValue[T any](value any) (T, bool) {
+	val, ok := value.(T)
+	if !ok && value == nil {
+		return val, any(val) == nil
+	}
+	return val, ok
+}
+
+// SetIfAbsent writes the value to the cache if the key doesn't exist.
+// Returns true if the value was written.
+func SetIfAbsent(c *Client, key string, value any) bool {
+	var stored bool
+	Compute(c, key, func(old any, exists bool) (any, ComputeAction) {
+		if exists {
+			return old, ComputeKeep
+		}
+		stored = true
+		return value, ComputeStore
+	})
+	return stored
+}
+
+// CompareAndSwap replaces the value of the key with newValue if the cached
+// value is equal to oldValue, as determined by the equal function. Missing
+// records, and values of another type, are never swapped. Returns true if the
+// value was swapped.
+func CompareAndSwap[T any](c *Client, key string, oldValue, newValue T, equal func(a, b T) bool) bool {
+	var swapped bool
+	compute(c, key, func(old T, isValue, _ bool) (T, ComputeAction) {
+		if !isValue || !equal(old, oldValue) {
+			return old, ComputeKeep
+		}
+		swapped = true
+		return newValue, ComputeStore
+	})
+	return swapped
+}
+
+// GetOrSet returns the cached value of the key if it exists. Otherwise, the
+// value is written to the cache and returned. The loaded result is true if
+// the value was retrieved from the cache, and false if it was written. Keys
+// that hold a missing record, or a value of another type, are left untouched,
+// and returned as the zero value of T with loaded set to true.
+func GetOrSet[T any](c *Client, key string, value T) (actual T, loaded bool) {
+	actual, _ = Compute(c, key, func(old T, exists bool) (T, ComputeAction) {
+		if exists {
+			loaded = true
+			return old, ComputeKeep
+		}
+		return value, ComputeStore
+	})
+	return actual, loaded
+}
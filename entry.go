@@ -1,12 +1,84 @@
 package sturdyc
 
-import "time"
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// write holds a value that is about to be written to the cache,
+// along with the information that was gathered while fetching it.
+type write struct {
+	value           any
+	isMissingRecord bool
+	fetchDuration   time.Duration
+	refresher       func()
+	validator       string
+	// token is the version of the shard when the fetch began. The write is
+	// dropped if the entry was written, or deleted, after the token was issued.
+	token uint64
+}
+
+// unconditionalWrite is used as the token for writes that should always be stored.
+const unconditionalWrite = math.MaxUint64
 
 type entry struct {
 	key                 string
 	value               any
+	writtenAt           time.Time
 	expiresAt           time.Time
 	refreshAt           time.Time
+	refreshDeadline     time.Time
+	fetchDuration       time.Duration
 	numOfRefreshRetries int
 	isMissingRecord     bool
+	// refreshBackoff is the number of times that the refresh interval has
+	// been doubled because refreshes returned the same value. It stops
+	// growing once the interval has reached the max refresh interval.
+	refreshBackoff int
+	// refresher is set when the entry can be refreshed proactively.
+	refresher func()
+	// validator is an opaque value, such as an ETag, that is passed to RevalidateFn.
+	validator string
+	// version is incremented every time that an entry is written to the shard.
+	version uint64
+	// fetched is set when the value was written by a fetch or refresh, rather
+	// than by a write that isn't conditioned on a token, such as Set.
+	fetched bool
+
+	// The access statistics are updated while holding a read lock.
+	accesses          atomic.Int64
+	accessWindowStart atomic.Int64
+	lastAccess        atomic.Int64
+}
+
+// recordAccess increments the number of times that the entry has been accessed
+// within the current window, and returns the updated count. A window of zero
+// counts every access since the entry was written.
+func (e *entry) recordAccess(now time.Time, window time.Duration) int64 {
+	nowNano := now.UnixNano()
+	e.lastAccess.Store(nowNano)
+	if window > 0 {
+		windowStart := e.accessWindowStart.Load()
+		if nowNano-windowStart > int64(window) && e.accessWindowStart.CompareAndSwap(windowStart, nowNano) {
+			e.accesses.Store(0)
+		}
+	}
+	return e.accesses.Add(1)
+}
+
+// accessesWithinWindow returns the number of times that the entry has been
+// accessed within the current window, without counting it as an access.
+func (e *entry) accessesWithinWindow(now time.Time, window time.Duration) int64 {
+	if window > 0 && now.UnixNano()-e.accessWindowStart.Load() > int64(window) {
+		return 0
+	}
+	return e.accesses.Load()
+}
+
+// inheritAccesses carries the access statistics over from the entry that is being replaced.
+func (e *entry) inheritAccesses(previous *entry) {
+	e.accesses.Store(previous.accesses.Load())
+	e.accessWindowStart.Store(previous.accessWindowStart.Load())
+	e.lastAccess.Store(previous.lastAccess.Load())
 }
@@ -0,0 +1,34 @@
+package sturdyc
+
+import "reflect"
+
+var boolType = reflect.TypeOf(true)
+
+// valuesEqual reports whether a refresh returned the same value as the one
+// that is cached. It uses the equal function if one has been provided, and
+// otherwise an Equal method on the new value, e.g. func (t T) Equal(other T) bool.
+// Values that can't be compared are considered to have changed.
+func valuesEqual(equalFn func(a, b any) bool, previous, value any) bool {
+	if equalFn != nil {
+		return equalFn(previous, value)
+	}
+
+	if previous == nil || value == nil || reflect.TypeOf(previous) != reflect.TypeOf(value) {
+		return false
+	}
+
+	method := reflect.ValueOf(value).MethodByName("Equal")
+	if !method.IsValid() {
+		return false
+	}
+
+	methodType := method.Type()
+	if methodType.NumIn() != 1 || methodType.NumOut() != 1 || methodType.Out(0) != boolType {
+		return false
+	}
+	if !reflect.TypeOf(previous).AssignableTo(methodType.In(0)) {
+		return false
+	}
+
+	return method.Call([]reflect.Value{reflect.ValueOf(previous)})[0].Bool()
+}
@@ -15,6 +15,10 @@ var (
 	// remaining records failed. The consumer can then choose if they want to
 	// proceed with the cached records or retry the operation.
 	ErrOnlyCachedRecords = errors.New("failed to fetch the records that we did not have cached")
+	// ErrNotModified should be returned from a RevalidateFn to indicate that
+	// the cached value is still valid. The cache is then going to extend the
+	// lifetime of the entry without replacing its value.
+	ErrNotModified = errors.New("record not modified")
 )
 
 func ErrIsStoreMissingRecordOrMissingRecord(err error) bool {
@@ -0,0 +1,136 @@
+package sturdyc
+
+import "unicode/utf8"
+
+// deleteChunkSize is the maximum number of entries that are deleted while
+// holding the lock of a shard. Larger deletions are split into chunks to
+// allow reads and writes to be performed in between them.
+const deleteChunkSize = 100
+
+// EvictionReason describes why an entry was removed from the cache.
+type EvictionReason int
+
+const (
+	// EvictionExpired is used for entries that were removed because their ttl expired.
+	EvictionExpired EvictionReason = iota
+	// EvictionCapacity is used for entries that were removed to make room for new entries.
+	EvictionCapacity
+	// EvictionDeleted is used for entries that were deleted explicitly.
+	EvictionDeleted
+)
+
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionExpired:
+		return "expired"
+	case EvictionCapacity:
+		return "capacity"
+	case EvictionDeleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// DeleteFunc deletes every entry for which fn returns true, and returns the
+// number of entries that were deleted. The entries are matched without
+// holding any locks, and entries that are written after they were matched
+// are left in the cache. Just like Delete, it prevents any in-flight fetches
+// of the deleted keys from writing them back to the cache.
+func (c *Client) DeleteFunc(fn func(key string, value any) bool) int {
+	var deleted int
+	for _, shard := range c.shards {
+		deleted += shard.deleteFunc(fn)
+	}
+	return deleted
+}
+
+// DeleteMatching deletes every entry whose key matches the pattern, and
+// returns the number of entries that were deleted. In the pattern, "*"
+// matches any sequence of characters, including an empty one, and "?"
+// matches a single character. Every other character, including slashes and
+// backslashes, is matched literally. That allows the escaped keys of
+// KeyEncodingEscaped and NamespacedKey to be used in patterns as they are.
+func (c *Client) DeleteMatching(pattern string) int {
+	return c.DeleteFunc(func(key string, _ any) bool {
+		return matchGlob(pattern, key)
+	})
+}
+
+// matchGlob reports whether the key matches the pattern of DeleteMatching.
+// When a character doesn't match, we backtrack to the last "*" and let it
+// consume one more character of the key.
+func matchGlob(pattern, key string) bool {
+	var p, k int
+	star, starKey := -1, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star, starKey = p, k
+				p++
+				continue
+			case '?':
+				_, size := utf8.DecodeRuneInString(key[k:])
+				p, k = p+1, k+size
+				continue
+			default:
+				if pattern[p] == key[k] {
+					p, k = p+1, k+1
+					continue
+				}
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		_, size := utf8.DecodeRuneInString(key[starKey:])
+		starKey += size
+		p, k = star+1, starKey
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// deleteFunc deletes the entries of the shard that fn returns true for.
+func (s *shard) deleteFunc(fn func(key string, value any) bool) int {
+	s.mu.RLock()
+	candidates := make([]*entry, 0, len(s.entries))
+	for _, e := range s.entries {
+		candidates = append(candidates, e)
+	}
+	s.mu.RUnlock()
+
+	matches := make([]*entry, 0)
+	for _, e := range candidates {
+		if fn(e.key, e.value) {
+			matches = append(matches, e)
+		}
+	}
+
+	var deleted int
+	for start := 0; start < len(matches); start += deleteChunkSize {
+		end := min(start+deleteChunkSize, len(matches))
+		deleted += s.deleteEntries(matches[start:end])
+	}
+	return deleted
+}
+
+// deleteEntries deletes the entries, unless they've been replaced since they were matched.
+func (s *shard) deleteEntries(entries []*entry) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deleted int
+	for _, e := range entries {
+		if current, ok := s.entries[e.key]; ok && current == e {
+			s.remove(e.key)
+			deleted++
+		}
+	}
+	s.reportEvictions(deleted)
+	return deleted
+}
@@ -8,7 +8,9 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/creativecreature/sturdyc"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -31,12 +33,27 @@ type TestMetricsRecorder struct {
 	evictedEntries  int
 	shards          map[int]int
 	batchSizes      []int
+	bufferFlushes   map[sturdyc.BufferFlushReason]int
+	fillRatios      []float64
+	refreshes       int
+	changedValues   int
+	droppedWrites   int
+	fetchDurations  map[string][]time.Duration
+	refreshOutcomes map[string][]sturdyc.RefreshOutcome
+	missingRecords  map[string]int
+	labeledFlushes  map[string][]sturdyc.BufferFlushReason
 }
 
 func newTestMetricsRecorder(numShards int) *TestMetricsRecorder {
 	return &TestMetricsRecorder{
-		shards:     make(map[int]int, numShards),
-		batchSizes: make([]int, 0),
+		shards:          make(map[int]int, numShards),
+		batchSizes:      make([]int, 0),
+		bufferFlushes:   make(map[sturdyc.BufferFlushReason]int),
+		fillRatios:      make([]float64, 0),
+		fetchDurations:  make(map[string][]time.Duration),
+		refreshOutcomes: make(map[string][]sturdyc.RefreshOutcome),
+		missingRecords:  make(map[string]int),
+		labeledFlushes:  make(map[string][]sturdyc.BufferFlushReason),
 	}
 }
 
@@ -55,6 +72,8 @@ func (r *TestMetricsRecorder) CacheMiss() {
 func (r *TestMetricsRecorder) ObserveCacheSize(_ func() int) {}
 
 func (r *TestMetricsRecorder) CacheBatchRefreshSize(n int) {
+	r.Lock()
+	defer r.Unlock()
 	r.batchSizes = append(r.batchSizes, n)
 }
 
@@ -82,6 +101,52 @@ func (r *TestMetricsRecorder) ShardIndex(index int) {
 	r.shards[index]++
 }
 
+func (r *TestMetricsRecorder) RefreshedValue(changed bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.refreshes++
+	if changed {
+		r.changedValues++
+	}
+}
+
+func (r *TestMetricsRecorder) StaleWriteDropped() {
+	r.Lock()
+	defer r.Unlock()
+	r.droppedWrites++
+}
+
+func (r *TestMetricsRecorder) RefreshBufferFlushed(reason sturdyc.BufferFlushReason, fillRatio float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.bufferFlushes[reason]++
+	r.fillRatios = append(r.fillRatios, fillRatio)
+}
+
+func (r *TestMetricsRecorder) FetchDuration(label string, duration time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	r.fetchDurations[label] = append(r.fetchDurations[label], duration)
+}
+
+func (r *TestMetricsRecorder) RefreshCompleted(label string, _ time.Duration, outcome sturdyc.RefreshOutcome) {
+	r.Lock()
+	defer r.Unlock()
+	r.refreshOutcomes[label] = append(r.refreshOutcomes[label], outcome)
+}
+
+func (r *TestMetricsRecorder) MissingRecordStored(label string) {
+	r.Lock()
+	defer r.Unlock()
+	r.missingRecords[label]++
+}
+
+func (r *TestMetricsRecorder) LabeledRefreshBufferFlushed(label string, reason sturdyc.BufferFlushReason, _ float64) {
+	r.Lock()
+	defer r.Unlock()
+	r.labeledFlushes[label] = append(r.labeledFlushes[label], reason)
+}
+
 func (r *TestMetricsRecorder) validateShardDistribution(t *testing.T, tolerancePercentage int) {
 	t.Helper()
 
@@ -223,3 +288,35 @@ func (f *FetchObserver) AssertMaxFetchCount(t *testing.T, count int) {
 		t.Errorf("expected fetch count to be at most %d, got %d", count, f.fetchCount)
 	}
 }
+
+func sortedFloats(values []float64) []float64 {
+	sorted := make([]float64, len(values))
+	copy(sorted, values)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// waitForWrite waits for a fetch to complete, and for its response to be
+// written to the cache. The fetch functions of the tests signal that they've
+// completed before the response is written, which means that moving the clock
+// straight away could happen before the entry gets its new refresh time.
+func waitForWrite[T any](t *testing.T, client *sturdyc.Client, key string, fetchCompleted <-chan struct{}) {
+	t.Helper()
+	select {
+	case <-fetchCompleted:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the fetch to complete")
+	}
+
+	// The test clock stands still, so the age is zero once the response is written.
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, info, ok := sturdyc.Peek[T](client, key); ok && info.Age == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the response to be written")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,69 @@
+package sturdyc
+
+import (
+	"context"
+	"errors"
+)
+
+// errFetchPanicked is returned to the callers that were waiting for an in-flight fetch that panicked.
+var errFetchPanicked = errors.New("sturdyc: the in-flight fetch panicked")
+
+// inFlightCall holds the result of a fetch that other callers can wait for.
+type inFlightCall struct {
+	done  chan struct{}
+	value any
+	err   error
+	// cancelled is set when the fetch failed because the
+	// context of the caller that performed it was cancelled.
+	cancelled bool
+}
+
+// fetchOnce calls fetch unless a fetch for the key is already in flight, in
+// which case we'll wait for that fetch to complete and share its result. The
+// waiting callers return early with the context's error if it's cancelled.
+// If the fetch fails because the context of the caller that performed it was
+// cancelled, the callers whose contexts are still live are going to retry the
+// fetch rather than sharing the error. Returns true if the result was shared
+// from another caller's fetch.
+func fetchOnce[T any](ctx context.Context, c *Client, key string, fetch func() (T, error)) (T, bool, error) {
+	c.inFlightMutex.Lock()
+	if call, ok := c.inFlight[key]; ok {
+		c.inFlightMutex.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			var zero T
+			return zero, true, ctx.Err()
+		}
+
+		if call.cancelled && ctx.Err() == nil {
+			return fetchOnce(ctx, c, key, fetch)
+		}
+
+		// The value could be of another type if the key is fetched with different
+		// type parameters. In that case, we'll have to perform the fetch ourselves.
+		value, ok := call.value.(T)
+		if !ok && call.value != nil {
+			value, err := fetch()
+			return value, false, err
+		}
+		c.stats.coalescedFetches.Add(1)
+		return value, true, call.err
+	}
+
+	call := &inFlightCall{done: make(chan struct{}), value: nil, err: errFetchPanicked, cancelled: false}
+	c.inFlight[key] = call
+	c.inFlightMutex.Unlock()
+
+	defer func() {
+		c.inFlightMutex.Lock()
+		delete(c.inFlight, key)
+		c.inFlightMutex.Unlock()
+		close(call.done)
+	}()
+
+	value, err := fetch()
+	call.value, call.err = value, err
+	call.cancelled = err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err())
+	return value, false, err
+}
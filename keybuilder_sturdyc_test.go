@@ -0,0 +1,41 @@
+// Code generated by sturdyc-keygen. DO NOT EDIT.
+
+package sturdyc_test
+
+import "github.com/creativecreature/sturdyc"
+
+// CacheKey writes the fields of generatedKeyParams to the key. It's used by sturdyc.PermutatedKey.
+func (g generatedKeyParams) CacheKey(w *sturdyc.KeyWriter) {
+	w.Field("")
+	w.FieldValue(&g.Wrapped)
+	w.Field("")
+	w.String(g.Query)
+	w.Field("")
+	w.Int(int64(g.Page))
+	w.Field("")
+	w.Uint(uint64(g.Priority))
+	w.Field("")
+	w.Bool(g.Archived)
+	w.Field("")
+	w.Strings(g.Tags)
+	w.Field("")
+	if g.Cursor == nil {
+		w.Nil()
+	} else {
+		w.String(*g.Cursor)
+	}
+	w.Field("")
+	if g.Since == nil {
+		w.Nil()
+	} else {
+		w.Time(*g.Since, 0)
+	}
+	w.Field("")
+	w.FieldValue(&g.Carrier)
+	w.Field("")
+	w.FieldValue(&g.Extra)
+	w.Field("day")
+	w.Time(g.Day, 86400000000000) // 24h0m0s
+	w.Field("filters")
+	w.FieldValue(&g.Filters)
+}
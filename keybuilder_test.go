@@ -0,0 +1,84 @@
+package sturdyc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/creativecreature/sturdyc"
+)
+
+//go:generate go run ./cmd/sturdyc-keygen -type=generatedKeyParams
+
+// Wrapped is embedded with a type argument by generatedKeyParams.
+type Wrapped[T any] struct {
+	Value T
+}
+
+type generatedKeyParams struct {
+	Wrapped[int]
+	Query    string
+	Page     int
+	Priority uint8
+	Archived bool
+	Tags     []string
+	Cursor   *string
+	Since    *time.Time
+	Day      time.Time `sturdyc:"name=day,truncate=24h"`
+	Carrier  carrierCode
+	Filters  map[string]int `sturdyc:"name=filters"`
+	Extra    any
+	internal string
+	Debug    bool `sturdyc:"-"`
+}
+
+// reflectedKeyParams has the same fields as generatedKeyParams, but none of its methods.
+type reflectedKeyParams generatedKeyParams
+
+func TestPermutatedKeyUsesGeneratedCacheKeys(t *testing.T) {
+	t.Parallel()
+
+	clock := sturdyc.NewTestClock(time.Now().Truncate(time.Minute))
+	clients := map[string]*sturdyc.Client{
+		"plain":   sturdyc.New(100, 1, time.Hour, 5),
+		"escaped": sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithKeyEncoding(sturdyc.KeyEncodingEscaped)),
+		"relative": sturdyc.New(100, 1, time.Hour, 5,
+			sturdyc.WithRelativeTimeKeyFormat(time.Minute),
+			sturdyc.WithClock(clock),
+		),
+	}
+
+	cursor := "next-page,2"
+	since := clock.Now().Add(-90 * time.Minute)
+	params := []generatedKeyParams{
+		{},
+		{
+			Wrapped:  Wrapped[int]{Value: 3},
+			Query:    "flights-from:ARN",
+			Page:     -2,
+			Priority: 7,
+			Archived: true,
+			Tags:     []string{"a,b", "c=d"},
+			Cursor:   &cursor,
+			Since:    &since,
+			Day:      clock.Now().Add(30 * time.Hour),
+			Carrier:  carrierCode{code: "SK"},
+			Filters:  map[string]int{"stops": 1, "bags": 2},
+			Extra:    []string{"a"},
+			internal: "ignored",
+			Debug:    true,
+		},
+		{Tags: []string{}},
+		{Extra: 1},
+		{Extra: "1"},
+	}
+
+	for name, client := range clients {
+		for _, p := range params {
+			want := client.PermutatedKey("prefix", reflectedKeyParams(p))
+			got := client.PermutatedKey("prefix", p)
+			if got != want {
+				t.Errorf("%s client: expected the generated key %q to be %q", name, got, want)
+			}
+		}
+	}
+}
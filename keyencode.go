@@ -0,0 +1,172 @@
+package sturdyc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxKeyDepth limits how deeply nested the values of a permutation struct
+// can be, which prevents pointers that reference themselves from recursing
+// forever.
+const maxKeyDepth = 32
+
+// CacheKeyer can be implemented by the types of permutation fields that want
+// to decide how they're written to the keys of PermutatedKey.
+type CacheKeyer interface {
+	CacheKeyFragment() string
+}
+
+var cacheKeyerType = reflect.TypeOf((*CacheKeyer)(nil)).Elem()
+
+// cacheKeyFragment returns the fragment of values that implement CacheKeyer,
+// either with a value or a pointer receiver.
+func cacheKeyFragment(v reflect.Value) (string, bool) {
+	if !v.CanInterface() {
+		return "", false
+	}
+	if keyer, ok := v.Interface().(CacheKeyer); ok {
+		return keyer.CacheKeyFragment(), true
+	}
+	if v.Kind() == reflect.Ptr || !reflect.PointerTo(v.Type()).Implements(cacheKeyerType) {
+		return "", false
+	}
+
+	// The value isn't addressable when the permutation struct is passed by
+	// value. Therefore, we'll have to copy it in order to call the method.
+	ptr := reflect.New(v.Type())
+	ptr.Elem().Set(v)
+	keyer, ok := ptr.Interface().(CacheKeyer)
+	if !ok {
+		return "", false
+	}
+	return keyer.CacheKeyFragment(), true
+}
+
+// writeKeyValue writes the value of a permutation field to the key. Slices
+// and arrays that are nested inside of other values are wrapped in brackets,
+// while the ones of the permutation struct are written without them.
+func (c *Client) writeKeyValue(sb *strings.Builder, v reflect.Value, truncation time.Duration, nested bool, depth int) {
+	if depth > maxKeyDepth {
+		panic("permutation struct is nested too deeply")
+	}
+
+	if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil() {
+		sb.WriteString(c.keyMarker("nil", `\nil`))
+		return
+	}
+
+	// The values of interface types are prefixed with their dynamic types when
+	// they're escaped. Otherwise, values of different types that are written
+	// the same way, such as 1 and "1", would produce the same key.
+	if v.Kind() == reflect.Interface && c.keyEncoding == KeyEncodingEscaped {
+		sb.WriteString(`\(`)
+		sb.WriteString(keyTypeEscaper.Replace(v.Elem().Type().String()))
+		sb.WriteString(")")
+		c.writeKeyValue(sb, v.Elem(), truncation, nested, depth+1)
+		return
+	}
+
+	if fragment, ok := cacheKeyFragment(v); ok {
+		sb.WriteString(c.keyValue(fragment))
+		return
+	}
+
+	//nolint:exhaustive // Every other kind is written with its default format.
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		// If it's not nil we'll dereference the pointer to handle its value.
+		c.writeKeyValue(sb, v.Elem(), truncation, nested, depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			sb.WriteString(c.keyMarker("nil", `\nilslice`))
+			return
+		}
+		c.writeKeyList(sb, v, nested, depth)
+	case reflect.Array:
+		c.writeKeyList(sb, v, nested, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			sb.WriteString(c.keyMarker("nil", `\nilmap`))
+			return
+		}
+		c.writeKeyMap(sb, v, depth)
+	case reflect.Struct:
+		if v.Type() == reflect.TypeOf(time.Time{}) {
+			sb.WriteString(c.keyValue(c.handleTime(v, truncation)))
+			return
+		}
+		c.writeKeyStruct(sb, v, depth)
+	default:
+		sb.WriteString(c.keyValue(fmt.Sprintf("%v", v.Interface())))
+	}
+}
+
+// writeKeyList writes the elements of a slice or an array, separated by commas.
+func (c *Client) writeKeyList(sb *strings.Builder, v reflect.Value, nested bool, depth int) {
+	if !nested && v.Len() < 1 {
+		sb.WriteString(c.keyMarker("empty", `\empty`))
+		return
+	}
+
+	if nested {
+		sb.WriteString("[")
+	}
+	for i := 0; i < v.Len(); i++ {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		c.writeKeyValue(sb, v.Index(i), 0, true, depth+1)
+	}
+	if nested {
+		sb.WriteString("]")
+	}
+}
+
+// writeKeyMap writes the entries of a map as key:value pairs, sorted by their keys.
+func (c *Client) writeKeyMap(sb *strings.Builder, v reflect.Value, depth int) {
+	type pair struct {
+		key   string
+		value string
+	}
+	pairs := make([]pair, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		var key, value strings.Builder
+		c.writeKeyValue(&key, iter.Key(), 0, true, depth+1)
+		c.writeKeyValue(&value, iter.Value(), 0, true, depth+1)
+		pairs = append(pairs, pair{key: key.String(), value: value.String()})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].key < pairs[j].key
+	})
+
+	sb.WriteString("{")
+	for i, p := range pairs {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(p.key)
+		sb.WriteString(":")
+		sb.WriteString(p.value)
+	}
+	sb.WriteString("}")
+}
+
+// writeKeyStruct writes the fields of a nested struct, which respect the sturdyc tags as well.
+func (c *Client) writeKeyStruct(sb *strings.Builder, v reflect.Value, depth int) {
+	sb.WriteString("{")
+	for i, keyField := range keyFields(v.Type()) {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		if keyField.name != "" {
+			sb.WriteString(keyField.name)
+			sb.WriteString("=")
+		}
+		c.writeKeyValue(sb, v.Field(keyField.index), keyField.truncation, true, depth+1)
+	}
+	sb.WriteString("}")
+}
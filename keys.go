@@ -1,52 +1,61 @@
 package sturdyc
 
 import (
+	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func handleSlice(v reflect.Value) string {
-	// If the value is a pointer to a slice, get the actual slice
-	if v.Kind() == reflect.Ptr {
-		v = v.Elem()
-	}
-
-	if v.Len() < 1 {
-		return "empty"
-	}
-
-	var sliceStrings []string
-	for i := 0; i < v.Len(); i++ {
-		sliceStrings = append(sliceStrings, fmt.Sprintf("%v", v.Index(i).Interface()))
-	}
+// KeyEncoding determines how PermutatedKey encodes the values of the fields.
+type KeyEncoding int
+
+const (
+	// KeyEncodingPlain writes the values as they are. It produces readable keys,
+	// but values that contain the separators can make different structs share
+	// the same key. For example, {A: "x-y", B: "z"} and {A: "x", B: "y-z"}.
+	KeyEncodingPlain KeyEncoding = iota
+	// KeyEncodingEscaped escapes backslashes, the "-" and "," separators, and
+	// the characters that delimit nested values, in every value. Nil and empty
+	// values are written as markers that start with a backslash, and values of
+	// interface types are prefixed with a marker of their dynamic type. This
+	// makes the keys of two structs equal only if the structs are, as long as
+	// the CacheKeyer fragments, and the names of the types, are unique.
+	KeyEncodingEscaped
+)
 
-	return strings.Join(sliceStrings, ",")
-}
+// keyEscaper is used to escape the values of KeyEncodingEscaped.
+var keyEscaper = strings.NewReplacer(
+	`\`, `\\`, "-", `\-`, ",", `\,`, ":", `\:`, "=", `\=`,
+	"{", `\{`, "}", `\}`, "[", `\[`, "]", `\]`,
+)
 
-func extractPermutation(cacheKey string) string {
-	idIndex := strings.LastIndex(cacheKey, "ID-")
+// keyTypeEscaper is used to escape the names of the types that are written in
+// front of interface values. The type is delimited by the parentheses.
+var keyTypeEscaper = strings.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
 
-	// "ID-" not found, return the original cache key.
-	if idIndex == -1 {
-		return cacheKey
+// keyValue encodes a value of a permutation field.
+func (c *Client) keyValue(value string) string {
+	if c.keyEncoding == KeyEncodingEscaped {
+		return keyEscaper.Replace(value)
 	}
+	return value
+}
 
-	// Find the last "-" before "ID-" to ensure we include "ID-" in the result
-	lastDashIndex := strings.LastIndex(cacheKey[:idIndex], "-")
-	// "-" not found before "ID-", return original string
-	if lastDashIndex == -1 {
-		return cacheKey
+// keyMarker returns the plain marker, or its escaped counterpart, for values such as nil.
+func (c *Client) keyMarker(plain, escaped string) string {
+	if c.keyEncoding == KeyEncodingEscaped {
+		return escaped
 	}
-
-	return cacheKey[:lastDashIndex+1]
+	return plain
 }
 
-func (c *Client) relativeTime(t time.Time) string {
-	now := c.clock.Now().Truncate(c.keyTruncation)
-	target := t.Truncate(c.keyTruncation)
+func (c *Client) relativeTime(t time.Time, bucket TimeBucket) string {
+	now := bucket(c.clock.Now())
+	target := bucket(t)
 	var diff time.Duration
 	var direction string
 	if target.After(now) {
@@ -62,33 +71,61 @@ func (c *Client) relativeTime(t time.Time) string {
 	return fmt.Sprintf("%s%dh%02dm%02ds", direction, hours, minutes, seconds)
 }
 
-// handleTime turns the time.Time into an epoch string.
-func (c *Client) handleTime(v reflect.Value) string {
-	if timestamp, ok := v.Interface().(time.Time); ok {
-		if !timestamp.IsZero() {
-			if c.useRelativeTimeKeyFormat {
-				return c.relativeTime(timestamp)
-			}
-			return strconv.FormatInt(timestamp.Unix(), 10)
-		}
+// handleTime turns the time.Time into an epoch string. The truncation of the
+// field is used if it's set, and the truncation of the client otherwise.
+func (c *Client) handleTime(v reflect.Value, truncation time.Duration) string {
+	var timestamp time.Time
+	if t, ok := v.Interface().(time.Time); ok {
+		timestamp = t
 	}
+	if t, ok := v.Interface().(*time.Time); ok && t != nil {
+		timestamp = *t
+	}
+	return c.formatTime(timestamp, truncation)
+}
 
-	if timestamp, ok := v.Interface().(*time.Time); ok {
-		if !timestamp.IsZero() {
-			if c.useRelativeTimeKeyFormat {
-				return c.relativeTime(*timestamp)
-			}
-			return strconv.FormatInt(timestamp.Unix(), 10)
-		}
+func (c *Client) formatTime(timestamp time.Time, truncation time.Duration) string {
+	if timestamp.IsZero() {
+		return "empty-time"
+	}
+
+	// The truncation of a struct tag overrides the bucket of the client.
+	bucket := c.keyTimeBucket
+	if truncation > 0 {
+		bucket = TruncateBucket(truncation)
 	}
-	return "empty-time"
+
+	if c.useRelativeTimeKeyFormat {
+		return c.relativeTime(timestamp, bucket)
+	}
+	if bucket != nil {
+		timestamp = bucket(timestamp)
+	}
+	return strconv.FormatInt(timestamp.Unix(), 10)
 }
 
 // PermutatedKey is a helper function for creating a cache key from a struct of
 // options. Passing anything but a struct for "permutationStruct" will result
 // in a panic. NOTE: time.Time are truncated on minutes. If you need more
 // precision, you'll have to convert it yourself into a string or epoch number.
+//
+// The fields can be configured with a sturdyc tag. `sturdyc:"-"` excludes the
+// field from the key, `sturdyc:"name=carrier"` writes the field as carrier=value
+// in a position that doesn't depend on the order of the fields, and
+// `sturdyc:"truncate=1h"` sets the truncation of a time.Time field.
+//
+// Maps, arrays, nested structs and pointers are encoded recursively, and the
+// entries of maps are sorted by their keys. Types that implement CacheKeyer
+// are written using their CacheKeyFragment. Structs with a CacheKey method
+// generated by cmd/sturdyc-keygen are written without using reflection.
 func (c *Client) PermutatedKey(prefix string, permutationStruct interface{}) string {
+	// Structs with a generated CacheKey method can be written without reflection.
+	if builder, ok := permutationStruct.(CacheKeyBuilder); ok {
+		w := newKeyWriter(c, prefix)
+		builder.CacheKey(w)
+		return c.hashedKey(prefix, w.sb.String())
+	}
+
 	var sb strings.Builder
 	sb.WriteString(prefix)
 	sb.WriteString("-")
@@ -104,68 +141,71 @@ func (c *Client) PermutatedKey(prefix string, permutationStruct interface{}) str
 		panic("val must be a struct")
 	}
 
-	for i := 0; i < v.NumField(); i++ {
-		field := v.Field(i)
-
-		// Check if the field is exported
-		if !field.CanInterface() {
-			continue // Skip unexported fields
-		}
+	for i, keyField := range keyFields(v.Type()) {
+		field := v.Field(keyField.index)
 
 		if i > 0 {
 			sb.WriteString("-")
 		}
-
-		if field.Kind() == reflect.Ptr {
-			if field.IsNil() {
-				sb.WriteString("nil")
-				continue
-			}
-			// If it's not nil we'll dereference the pointer to handle its value.
-			field = field.Elem()
+		if keyField.name != "" {
+			sb.WriteString(keyField.name)
+			sb.WriteString("=")
 		}
 
-		//nolint:exhaustive // We only need special logic for slices and time.Time values.
-		switch field.Kind() {
-		case reflect.Slice:
-			if field.IsNil() {
-				sb.WriteString("nil")
-			} else {
-				sliceString := handleSlice(field)
-				sb.WriteString(sliceString)
-			}
-		case reflect.Struct:
-			if field.Type() == reflect.TypeOf(time.Time{}) {
-				sb.WriteString(c.handleTime(field))
-				continue
-			}
-			sb.WriteString(fmt.Sprintf("%v", field.Interface()))
-		default:
-			sb.WriteString(fmt.Sprintf("%v", field.Interface()))
-		}
+		c.writeKeyValue(&sb, field, keyField.truncation, false, 0)
 	}
 
-	return sb.String()
+	return c.hashedKey(prefix, sb.String())
 }
 
-// BatchKeyFn provides a function for that can be used in conjunction with "GetFetchBatch".
-// It takes in a prefix, and returns a function that will append an ID suffix for each item.
-func (c *Client) BatchKeyFn(prefix string) KeyFn {
-	return func(id string) string {
-		return fmt.Sprintf("%s-ID-%s", prefix, id)
+// hashedKey replaces the permutation portion of the key with its fnv128a hash
+// if it's long enough. With KeyEncodingEscaped, the hash is marked with a
+// backslash, which the escaped values can't start with. Therefore, it can't
+// be mistaken for a permutation that happens to look like one. The plain
+// marker offers no such guarantee, just like the rest of KeyEncodingPlain.
+func (c *Client) hashedKey(prefix, key string) string {
+	permutation := key[len(prefix)+1:]
+	if c.keyHashThreshold < 1 || len(permutation) < c.keyHashThreshold {
+		return key
 	}
+
+	h := fnv.New128a()
+	h.Write([]byte(permutation))
+	return prefix + "-" + c.keyMarker("hash:", `\hash:`) + hex.EncodeToString(h.Sum(nil))
 }
 
-// PermutatedBatchKeyFn provides a function that can be used in conjunction
+// batchKeyFn is the GroupKeyFunc returned by BatchKeyFn and PermutatedBatchKeyFn.
+// The group is resolved on every call so that keys with relative time formats
+// stay in sync with the clock.
+type batchKeyFn struct {
+	groupFn func() string
+}
+
+func (b batchKeyFn) Key(id string) string {
+	return b.Group() + "ID-" + id
+}
+
+func (b batchKeyFn) Group() string {
+	return b.groupFn()
+}
+
+// BatchKeyFn provides a GroupKeyFunc that can be used in conjunction with "GetFetchBatch".
+// It takes in a prefix, and returns keys that append an ID suffix for each item.
+func (c *Client) BatchKeyFn(prefix string) GroupKeyFunc {
+	return batchKeyFn{groupFn: func() string {
+		return prefix + "-"
+	}}
+}
+
+// PermutatedBatchKeyFn provides a GroupKeyFunc that can be used in conjunction
 // with GetFetchBatch. It takes a prefix, and a struct where the fields are
 // concatenated with the id in order to make a unique key. Passing anything but
 // a struct for "permutationStruct" will result in a panic. This function is useful
 // when the id isn't enough in itself to uniquely identify a record.
 // NOTE: time.Time are truncated on minutes. If you need more precision, you'll
 // have to convert it yourself into a string or epoch number.
-func (c *Client) PermutatedBatchKeyFn(prefix string, permutationStruct interface{}) KeyFn {
-	return func(id string) string {
-		key := c.PermutatedKey(prefix, permutationStruct)
-		return fmt.Sprintf("%s-ID-%s", key, id)
-	}
+func (c *Client) PermutatedBatchKeyFn(prefix string, permutationStruct interface{}) GroupKeyFunc {
+	return batchKeyFn{groupFn: func() string {
+		return c.PermutatedKey(prefix, permutationStruct) + "-"
+	}}
 }
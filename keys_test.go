@@ -1,7 +1,9 @@
 package sturdyc_test
 
 import (
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -174,9 +176,439 @@ func TestPermutatedBatchKeyFn(t *testing.T) {
 		limit:           2,
 	})
 	want := "cache-key-true-ID-1"
-	got := cacheKeyFunc("1")
+	got := cacheKeyFunc.Key("1")
 
 	if got != want {
 		t.Errorf("got: %s wanted: %s", got, want)
 	}
+
+	wantGroup := "cache-key-true-"
+	if group := cacheKeyFunc.Group(); group != wantGroup {
+		t.Errorf("got group: %s wanted: %s", group, wantGroup)
+	}
+}
+
+func TestNamespacedKeyFn(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5)
+	keyFn := client.NamespacedKeyFn("tenant", client.BatchKeyFn("users"))
+	groupKeyFn, ok := keyFn.(sturdyc.GroupKeyFunc)
+	if !ok {
+		t.Fatal("expected the namespaced key function to preserve the group")
+	}
+
+	if got, want := keyFn.Key("1"), "tenant-g0-users-ID-1"; got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+	if got, want := groupKeyFn.Group(), "tenant-g0-users-"; got != want {
+		t.Errorf("got group: %s wanted: %s", got, want)
+	}
+
+	client.BumpNamespace("tenant")
+	if got, want := keyFn.Key("1"), "tenant-g1-users-ID-1"; got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+	if got, want := groupKeyFn.Group(), "tenant-g1-users-"; got != want {
+		t.Errorf("got group: %s wanted: %s", got, want)
+	}
+
+	ungrouped := client.NamespacedKeyFn("tenant", sturdyc.KeyFn(func(id string) string { return "user-" + id }))
+	if _, ok := ungrouped.(sturdyc.GroupKeyFunc); ok {
+		t.Error("expected the namespaced key function to not have a group")
+	}
+	if got, want := ungrouped.Key("1"), "tenant-g1-user-1"; got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+}
+
+func TestNamespacedKeysCannotCollide(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5)
+
+	first := client.NamespacedKey("a", "g0-x")
+	second := client.NamespacedKey("a-g0", "x")
+	if first == second {
+		t.Errorf("expected the namespaces to produce different keys, got %q for both", first)
+	}
+	if second != `a\-g0-g0-x` {
+		t.Errorf("expected the dash of the namespace to be escaped, got %q", second)
+	}
+	if third := client.NamespacedKey(`a\`, "-g0-x"); third == first || third == second {
+		t.Errorf("expected backslashes in the namespace to be escaped, got %q", third)
+	}
+}
+
+func TestNamespacePrefix(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5)
+
+	if got, want := client.NamespacePrefix(`a-b\`), `a\-b\\-g0-`; got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+	client.BumpNamespace(`a-b\`)
+	prefix := client.NamespacePrefix(`a-b\`)
+	if want := `a\-b\\-g1-`; prefix != want {
+		t.Errorf("got: %s wanted: %s", prefix, want)
+	}
+	if got, want := client.NamespacedKey(`a-b\`, "x"), prefix+"x"; got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+}
+
+type escapedKeyNested struct {
+	X string
+	Y []string
+}
+
+type escapedKeyParams struct {
+	A string
+	B string
+	C []string
+	D *string
+	E int
+	F map[string]string
+	G escapedKeyNested
+	H any
+}
+
+func TestEscapedKeyEncodingPreventsCollisions(t *testing.T) {
+	t.Parallel()
+
+	plainClient := sturdyc.New(100, 1, time.Hour, 5)
+	escapedClient := sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithKeyEncoding(sturdyc.KeyEncodingEscaped))
+
+	a := escapedKeyParams{A: "x-y", B: "z", C: []string{"a,b"}, D: nil, E: 1, F: nil, G: escapedKeyNested{}, H: 1}
+	b := escapedKeyParams{A: "x", B: "y-z", C: []string{"a", "b"}, D: nil, E: 1, F: nil, G: escapedKeyNested{}, H: "1"}
+	if plainClient.PermutatedKey("key", a) != plainClient.PermutatedKey("key", b) {
+		t.Fatal("expected the plain encoding to produce colliding keys")
+	}
+
+	want := `key-x\-y-z-a\,b-\nil-1-\nilmap-{,\nilslice}-\(int)1`
+	if got := escapedClient.PermutatedKey("key", a); got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+	want = `key-x-y\-z-a,b-\nil-1-\nilmap-{,\nilslice}-\(string)1`
+	if got := escapedClient.PermutatedKey("key", b); got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+}
+
+func FuzzEscapedKeyEncoding(f *testing.F) {
+	f.Add("x-y", "z", "a,b", false, "", 1, "", uint8(1), "x", "y-z", "a|b", false, "", 1, "", uint8(2))
+	f.Add("nil", "", "", true, "nil", 0, "a:b", uint8(0), `\nil`, "", "", false, "", 0, "a:b|", uint8(0))
+	f.Add(`\`, "-", "", false, "empty", -1, "k:v", uint8(3), `\-`, "", "empty", true, "", -1, "k:v", uint8(4))
+	f.Add("", "", "|", false, `,`, 10, ":", uint8(5), "", "", "", false, `\,`, 10, "", uint8(5))
+	f.Add("a", "", "", false, "", 12, "{a:b}", uint8(6), "a", "", "", false, "", 12, "{a:b}", uint8(2))
+
+	client := sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithKeyEncoding(sturdyc.KeyEncodingEscaped))
+	params := func(a, b, c string, nilSlice bool, d string, e int, m string, kind uint8) escapedKeyParams {
+		// The slice is derived from c, and d is used as the pointer unless it's empty.
+		var slice []string
+		if !nilSlice {
+			slice = strings.Split(c, "|")
+			if c == "" {
+				slice = []string{}
+			}
+		}
+		var ptr *string
+		if d != "" {
+			ptr = &d
+		}
+		// The map is made of the key:value pairs of m, and is nil if m is empty.
+		var entries map[string]string
+		if m != "" {
+			entries = make(map[string]string)
+			for _, pair := range strings.Split(m, "|") {
+				key, value, _ := strings.Cut(pair, ":")
+				entries[key] = value
+			}
+		}
+		// The interface field holds values of different types that are written the same way.
+		var value any
+		switch kind % 7 {
+		case 1:
+			value = e
+		case 2:
+			value = strconv.Itoa(e)
+		case 3:
+			value = slice
+		case 4:
+			value = a
+		case 5:
+			value = entries
+		case 6:
+			value = escapedKeyNested{X: m, Y: slice}
+		}
+		return escapedKeyParams{
+			A: a, B: b, C: slice, D: ptr, E: e, F: entries,
+			G: escapedKeyNested{X: m, Y: slice}, H: value,
+		}
+	}
+
+	f.Fuzz(func(t *testing.T,
+		a1, b1, c1 string, nil1 bool, d1 string, e1 int, m1 string, kind1 uint8,
+		a2, b2, c2 string, nil2 bool, d2 string, e2 int, m2 string, kind2 uint8,
+	) {
+		first := params(a1, b1, c1, nil1, d1, e1, m1, kind1)
+		second := params(a2, b2, c2, nil2, d2, e2, m2, kind2)
+		firstKey, secondKey := client.PermutatedKey("key", first), client.PermutatedKey("key", second)
+		if equal := reflect.DeepEqual(first, second); equal != (firstKey == secondKey) {
+			t.Errorf("structs equal: %t, keys equal: %t\n%#v => %s\n%#v => %s",
+				equal, firstKey == secondKey, first, firstKey, second, secondKey,
+			)
+		}
+	})
+}
+
+func TestPermutatedKeyStructTags(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 5, 1, 10, 42, 30, 0, time.UTC)
+	client := sturdyc.New(100, 1, time.Hour, 5)
+
+	type shipmentParams struct {
+		Country   string
+		Carrier   string    `sturdyc:"name=carrier"`
+		RequestID string    `sturdyc:"-"`
+		Day       time.Time `sturdyc:"name=day,truncate=24h"`
+		Hour      time.Time `sturdyc:"truncate=1h"`
+	}
+	// The named, and excluded, fields can be moved without changing the key.
+	type reorderedShipmentParams struct {
+		Day       time.Time `sturdyc:"truncate=24h,name=day"`
+		Country   string
+		RequestID string    `sturdyc:"-"`
+		Hour      time.Time `sturdyc:"truncate=1h"`
+		Carrier   string    `sturdyc:"name=carrier"`
+	}
+
+	hour := strconv.FormatInt(now.Truncate(time.Hour).Unix(), 10)
+	day := strconv.FormatInt(now.Truncate(24*time.Hour).Unix(), 10)
+	want := "shipments-se-" + hour + "-carrier=dhl-day=" + day
+
+	got := client.PermutatedKey("shipments", shipmentParams{
+		Country:   "se",
+		Carrier:   "dhl",
+		RequestID: "abc",
+		Day:       now,
+		Hour:      now,
+	})
+	if got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+
+	got = client.PermutatedKey("shipments", reorderedShipmentParams{
+		Day:       now,
+		Country:   "se",
+		RequestID: "def",
+		Hour:      now,
+		Carrier:   "dhl",
+	})
+	if got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+}
+
+func TestPermutatedKeyPanicsOnInvalidStructTags(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5)
+	assertPanic := func(name string, permutationStruct any) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected %s to panic", name)
+			}
+		}()
+		client.PermutatedKey("key", permutationStruct)
+	}
+
+	assertPanic("an unknown option", struct {
+		A string `sturdyc:"unknown"`
+	}{})
+	assertPanic("a name with a separator", struct {
+		A string `sturdyc:"name=a-b"`
+	}{})
+	assertPanic("a duplicated name", struct {
+		A string `sturdyc:"name=a"`
+		B string `sturdyc:"name=a"`
+	}{})
+	assertPanic("an invalid truncation", struct {
+		A time.Time `sturdyc:"truncate=often"`
+	}{})
+	assertPanic("a truncation of a non-time field", struct {
+		A string `sturdyc:"truncate=1h"`
+	}{})
+}
+
+type carrierCode struct {
+	code string
+}
+
+func (c carrierCode) CacheKeyFragment() string {
+	return "carrier:" + c.code
+}
+
+type region struct {
+	name string
+}
+
+func (r *region) CacheKeyFragment() string {
+	return "region:" + r.name
+}
+
+func TestPermutatedKeyEncodesNestedValues(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5)
+
+	type dimensions struct {
+		Width  int
+		Height *int
+		Unit   string `sturdyc:"name=unit"`
+	}
+	type params struct {
+		Labels     map[string]int
+		Dimensions dimensions
+		Pointer    *dimensions
+		Matrix     [][]int
+		Array      [2]string
+		Carrier    carrierCode
+		Region     region
+		Any        any
+		Empty      map[string]int
+	}
+
+	height := 20
+	permutation := params{
+		Labels:     map[string]int{"b": 2, "c": 3, "a": 1},
+		Dimensions: dimensions{Width: 10, Height: &height, Unit: "cm"},
+		Pointer:    nil,
+		Matrix:     [][]int{{1, 2}, {}},
+		Array:      [2]string{"x", "y"},
+		Carrier:    carrierCode{code: "dhl"},
+		Region:     region{name: "eu"},
+		Any:        []string{"z"},
+		Empty:      map[string]int{},
+	}
+
+	want := "key-{a:1,b:2,c:3}-{10,20,unit=cm}-nil-[1,2],[]-x,y-carrier:dhl-region:eu-z-{}"
+	for i := 0; i < 10; i++ {
+		if got := client.PermutatedKey("key", permutation); got != want {
+			t.Fatalf("got: %s wanted: %s", got, want)
+		}
+	}
+
+	escapedClient := sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithKeyEncoding(sturdyc.KeyEncodingEscaped))
+	permutation.Labels = map[string]int{"a:1,b": 2}
+	want = `key-{a\:1\,b:2}-{10,20,unit=cm}-\nil-[1,2],[]-x,y-carrier\:dhl-region\:eu-\([]string)z-{}`
+	if got := escapedClient.PermutatedKey("key", permutation); got != want {
+		t.Errorf("got: %s wanted: %s", got, want)
+	}
+}
+
+func TestHashedPermutationKeys(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithHashedPermutationKeys(64))
+
+	type params struct {
+		IDs []string
+	}
+	ids := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+
+	short := client.PermutatedKey("flights", params{IDs: []string{"1", "2"}})
+	if short != "flights-1,2" {
+		t.Errorf("expected short permutations to be readable, got %q", short)
+	}
+
+	long := client.PermutatedKey("flights", params{IDs: ids})
+	if !strings.HasPrefix(long, "flights-hash:") || len(long) != len("flights-hash:")+32 {
+		t.Errorf("expected the long permutation to be hashed, got %q", long)
+	}
+	if again := client.PermutatedKey("flights", params{IDs: ids}); again != long {
+		t.Errorf("expected the hash to be stable, got %q and %q", long, again)
+	}
+	if other := client.PermutatedKey("flights", params{IDs: ids[1:]}); other == long {
+		t.Errorf("expected different permutations to have different hashes, got %q", other)
+	}
+
+	keyFn := client.PermutatedBatchKeyFn("flights", params{IDs: ids})
+	batchKey := keyFn.Key("42")
+	if batchKey != long+"-ID-42" {
+		t.Errorf("expected the batch key to keep the ID suffix, got %q", batchKey)
+	}
+	if group := keyFn.Group(); !strings.HasPrefix(batchKey, group) {
+		t.Errorf("expected the batch key %q to be in the group %q", batchKey, group)
+	}
+
+	sturdyc.Set(client, batchKey, 1)
+	sturdyc.Set(client, short, 2)
+	if keys := client.Keys("flights-"); len(keys) != 2 {
+		t.Errorf("expected prefix lookups to find both keys, got %v", keys)
+	}
+}
+
+func TestCalendarTimeBuckets(t *testing.T) {
+	t.Parallel()
+
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	at := func(day, hour, minute int) time.Time {
+		// March 11th 2024 is a Monday.
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, loc)
+	}
+
+	testCases := []struct {
+		name   string
+		bucket sturdyc.TimeBucket
+		time   time.Time
+		want   time.Time
+	}{
+		{"day", sturdyc.DayBucket(loc), at(13, 1, 30), at(13, 0, 0)},
+		{"day in another location", sturdyc.DayBucket(time.UTC), at(13, 1, 30), at(12, 2, 0)},
+		{"iso week", sturdyc.ISOWeekBucket(loc), at(13, 12, 0), at(11, 0, 0)},
+		{"iso week on a sunday", sturdyc.ISOWeekBucket(loc), at(17, 23, 59), at(11, 0, 0)},
+		{"business hours", sturdyc.BusinessHoursBucket(loc, 9*time.Hour, 17*time.Hour), at(13, 10, 0), at(13, 9, 0)},
+		{"after closing", sturdyc.BusinessHoursBucket(loc, 9*time.Hour, 17*time.Hour), at(13, 18, 0), at(13, 17, 0)},
+		{"before opening", sturdyc.BusinessHoursBucket(loc, 9*time.Hour, 17*time.Hour), at(14, 8, 0), at(13, 17, 0)},
+		{"weekend", sturdyc.BusinessHoursBucket(loc, 9*time.Hour, 17*time.Hour), at(16, 12, 0), at(15, 17, 0)},
+		{"monday morning", sturdyc.BusinessHoursBucket(loc, 9*time.Hour, 17*time.Hour), at(18, 8, 0), at(15, 17, 0)},
+	}
+	for _, tc := range testCases {
+		if got := tc.bucket(tc.time); !got.Equal(tc.want) {
+			t.Errorf("%s: expected %s to belong to the bucket that starts at %s, got %s", tc.name, tc.time, tc.want, got)
+		}
+	}
+
+	type params struct {
+		Departure time.Time
+	}
+
+	// Absolute buckets don't depend on the current time.
+	absoluteClient := sturdyc.New(100, 1, time.Hour, 5, sturdyc.WithAbsoluteTimeBucketKeyFormat(sturdyc.DayBucket(loc)))
+	morning := absoluteClient.PermutatedKey("flights", params{Departure: at(13, 6, 0)})
+	evening := absoluteClient.PermutatedKey("flights", params{Departure: at(13, 22, 0)})
+	if want := "flights-" + strconv.FormatInt(at(13, 0, 0).Unix(), 10); morning != want || evening != want {
+		t.Errorf("expected both keys to be %q, got %q and %q", want, morning, evening)
+	}
+
+	// Relative buckets change for every key as the clock moves into the next bucket.
+	clock := sturdyc.NewTestClock(at(13, 23, 30))
+	relativeClient := sturdyc.New(100, 1, time.Hour, 5,
+		sturdyc.WithRelativeTimeBucketKeyFormat(sturdyc.DayBucket(loc)),
+		sturdyc.WithClock(clock),
+	)
+	if key := relativeClient.PermutatedKey("flights", params{Departure: at(14, 10, 0)}); key != "flights-(+)24h00m00s" {
+		t.Errorf("expected the departure to be one day ahead, got %q", key)
+	}
+	clock.Add(time.Hour)
+	if key := relativeClient.PermutatedKey("flights", params{Departure: at(14, 10, 0)}); key != "flights-(-)0h00m00s" {
+		t.Errorf("expected the departure to be on the same day, got %q", key)
+	}
 }
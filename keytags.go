@@ -0,0 +1,103 @@
+package sturdyc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyField describes how a field of a permutation struct is written to the key.
+type keyField struct {
+	index int
+	// name is set by the name option of the sturdyc tag.
+	name string
+	// truncation is set by the truncate option of the sturdyc tag, and
+	// overrides the truncation of WithRelativeTimeKeyFormat.
+	truncation time.Duration
+}
+
+// keyFieldsCache holds the key fields of every type that has been used with PermutatedKey.
+var keyFieldsCache sync.Map
+
+// keyFields returns the fields of the struct type that should be written to
+// the key, in the order that they should be written. Fields without a name
+// are written in the order that they're declared, followed by the named
+// fields sorted by their name. That allows named fields to be reordered
+// without changing the keys.
+func keyFields(t reflect.Type) []keyField {
+	if cached, ok := keyFieldsCache.Load(t); ok {
+		fields, _ := cached.([]keyField)
+		return fields
+	}
+
+	fields := parseKeyFields(t)
+	keyFieldsCache.Store(t, fields)
+	return fields
+}
+
+// parseKeyFields reads the sturdyc tags of the struct type, and panics if a tag is malformed.
+func parseKeyFields(t reflect.Type) []keyField {
+	unnamed := make([]keyField, 0, t.NumField())
+	named := make([]keyField, 0)
+	names := make(map[string]struct{})
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+
+		tag := structField.Tag.Get("sturdyc")
+		if tag == "-" {
+			continue
+		}
+
+		field := keyField{index: i, name: "", truncation: 0}
+		for _, option := range strings.Split(tag, ",") {
+			if option == "" {
+				continue
+			}
+			key, value, _ := strings.Cut(option, "=")
+			switch key {
+			case "name":
+				if value == "" || strings.ContainsAny(value, `-,=\`) {
+					panic(fmt.Sprintf("sturdyc tag of field %s has an invalid name %q", structField.Name, value))
+				}
+				if _, ok := names[value]; ok {
+					panic(fmt.Sprintf("sturdyc tag of field %s reuses the name %q", structField.Name, value))
+				}
+				names[value] = struct{}{}
+				field.name = value
+			case "truncate":
+				truncation, err := time.ParseDuration(value)
+				if err != nil || truncation <= 0 {
+					panic(fmt.Sprintf("sturdyc tag of field %s has an invalid truncation %q", structField.Name, value))
+				}
+				if !isTimeType(structField.Type) {
+					panic(fmt.Sprintf("sturdyc tag of field %s can only truncate time.Time values", structField.Name))
+				}
+				field.truncation = truncation
+			default:
+				panic(fmt.Sprintf("sturdyc tag of field %s has an unknown option %q", structField.Name, option))
+			}
+		}
+
+		if field.name != "" {
+			named = append(named, field)
+			continue
+		}
+		unnamed = append(unnamed, field)
+	}
+
+	sort.Slice(named, func(i, j int) bool {
+		return named[i].name < named[j].name
+	})
+	return append(unnamed, named...)
+}
+
+func isTimeType(t reflect.Type) bool {
+	timeType := reflect.TypeOf(time.Time{})
+	return t == timeType || (t.Kind() == reflect.Ptr && t.Elem() == timeType)
+}
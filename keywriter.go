@@ -0,0 +1,107 @@
+package sturdyc
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheKeyBuilder is implemented by the CacheKey methods that are generated by
+// cmd/sturdyc-keygen. PermutatedKey, and PermutatedBatchKeyFn, use the method
+// instead of reflection when the permutation struct implements it.
+type CacheKeyBuilder interface {
+	CacheKey(w *KeyWriter)
+}
+
+// KeyWriter writes the fields of a permutation struct to a key, using the
+// same format, and key encoding, as PermutatedKey.
+type KeyWriter struct {
+	client *Client
+	sb     strings.Builder
+	fields int
+}
+
+func newKeyWriter(c *Client, prefix string) *KeyWriter {
+	w := &KeyWriter{client: c, sb: strings.Builder{}, fields: 0}
+	w.sb.WriteString(prefix)
+	w.sb.WriteString("-")
+	return w
+}
+
+// Field begins the next field of the key. The name should be empty unless
+// the field has been named with a sturdyc tag.
+func (w *KeyWriter) Field(name string) {
+	if w.fields > 0 {
+		w.sb.WriteString("-")
+	}
+	w.fields++
+	if name != "" {
+		w.sb.WriteString(name)
+		w.sb.WriteString("=")
+	}
+}
+
+// String writes a string value.
+func (w *KeyWriter) String(v string) {
+	w.sb.WriteString(w.client.keyValue(v))
+}
+
+// Int writes a signed integer value.
+func (w *KeyWriter) Int(v int64) {
+	w.sb.WriteString(w.client.keyValue(strconv.FormatInt(v, 10)))
+}
+
+// Uint writes an unsigned integer value.
+func (w *KeyWriter) Uint(v uint64) {
+	w.sb.WriteString(w.client.keyValue(strconv.FormatUint(v, 10)))
+}
+
+// Bool writes a boolean value.
+func (w *KeyWriter) Bool(v bool) {
+	w.sb.WriteString(w.client.keyValue(strconv.FormatBool(v)))
+}
+
+// Time writes a time.Time value. A truncation of zero uses the time bucket of the client.
+func (w *KeyWriter) Time(v time.Time, truncation time.Duration) {
+	w.sb.WriteString(w.client.keyValue(w.client.formatTime(v, truncation)))
+}
+
+// Strings writes a slice of strings.
+func (w *KeyWriter) Strings(v []string) {
+	if v == nil {
+		w.sb.WriteString(w.client.keyMarker("nil", `\nilslice`))
+		return
+	}
+	if len(v) == 0 {
+		w.sb.WriteString(w.client.keyMarker("empty", `\empty`))
+		return
+	}
+	for i, s := range v {
+		if i > 0 {
+			w.sb.WriteString(",")
+		}
+		w.sb.WriteString(w.client.keyValue(s))
+	}
+}
+
+// Nil writes the value of a nil pointer.
+func (w *KeyWriter) Nil() {
+	w.sb.WriteString(w.client.keyMarker("nil", `\nil`))
+}
+
+// Value writes any other value using reflection.
+func (w *KeyWriter) Value(v any) {
+	if v == nil {
+		w.Nil()
+		return
+	}
+	w.client.writeKeyValue(&w.sb, reflect.ValueOf(v), 0, false, 0)
+}
+
+// FieldValue writes the value that ptr points to using reflection. Unlike
+// Value, it keeps the declared type of the field, which makes the values of
+// fields with interface types get written along with their dynamic types.
+func (w *KeyWriter) FieldValue(ptr any) {
+	w.client.writeKeyValue(&w.sb, reflect.ValueOf(ptr).Elem(), 0, false, 0)
+}
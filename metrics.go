@@ -0,0 +1,154 @@
+package sturdyc
+
+import (
+	"errors"
+	"time"
+)
+
+// BufferFlushReason describes what caused a refresh buffer to be flushed.
+type BufferFlushReason int
+
+const (
+	// BufferFlushSize is used when a buffer was flushed because it reached the batch size.
+	BufferFlushSize BufferFlushReason = iota
+	// BufferFlushTimeout is used when a buffer was flushed because its timeout expired.
+	BufferFlushTimeout
+	// BufferFlushManual is used when a buffer was flushed by FlushRefreshBuffers.
+	BufferFlushManual
+)
+
+func (r BufferFlushReason) String() string {
+	switch r {
+	case BufferFlushSize:
+		return "size"
+	case BufferFlushTimeout:
+		return "timeout"
+	case BufferFlushManual:
+		return "manual"
+	default:
+		return "unknown"
+	}
+}
+
+// RefreshBufferMetricsRecorder can be implemented by a MetricsRecorder that
+// wants to know when refresh buffers are flushed. The fill ratio is the size
+// of the flushed batch divided by the batch size of the refresh buffering.
+type RefreshBufferMetricsRecorder interface {
+	RefreshBufferFlushed(reason BufferFlushReason, fillRatio float64)
+}
+
+// RefreshChangeMetricsRecorder can be implemented by a MetricsRecorder that
+// wants to know if refreshes changed the cached values. It's only reported
+// when WithChangeAwareRefreshes is used, and the ratio of changed refreshes
+// can be derived from the number of calls with changed set to true.
+type RefreshChangeMetricsRecorder interface {
+	RefreshedValue(changed bool)
+}
+
+// DroppedWriteMetricsRecorder can be implemented by a MetricsRecorder that
+// wants to know when the response of a fetch or refresh was discarded because
+// the key was written, or deleted, while the request was in flight. Responses
+// that are discarded because another fetch or refresh of the key wrote its
+// response first aren't reported.
+type DroppedWriteMetricsRecorder interface {
+	StaleWriteDropped()
+}
+
+// FetchMetricsRecorder can be implemented by a MetricsRecorder that wants to
+// know how long it took to fetch the records that weren't cached. Failed
+// fetches are reported as well. The label is derived from the key by the
+// function of WithMetricsLabeler, and is empty unless it has been configured.
+type FetchMetricsRecorder interface {
+	FetchDuration(label string, duration time.Duration)
+}
+
+// RefreshOutcome describes the result of a background refresh.
+type RefreshOutcome int
+
+const (
+	// RefreshSucceeded is used when the refresh returned a value.
+	RefreshSucceeded RefreshOutcome = iota
+	// RefreshNotModified is used when a revalidation returned ErrNotModified.
+	RefreshNotModified
+	// RefreshMissingRecord is used when the refresh reported that the record is missing.
+	RefreshMissingRecord
+	// RefreshFailed is used when the refresh returned any other error.
+	RefreshFailed
+)
+
+func (o RefreshOutcome) String() string {
+	switch o {
+	case RefreshSucceeded:
+		return "succeeded"
+	case RefreshNotModified:
+		return "not_modified"
+	case RefreshMissingRecord:
+		return "missing_record"
+	case RefreshFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// RefreshMetricsRecorder can be implemented by a MetricsRecorder that wants
+// to know the duration and outcome of the background refreshes. Batch
+// refreshes are reported once, with the label of the first key in the batch.
+type RefreshMetricsRecorder interface {
+	RefreshCompleted(label string, duration time.Duration, outcome RefreshOutcome)
+}
+
+// MissingRecordMetricsRecorder can be implemented by a MetricsRecorder that
+// wants to know when records are stored as missing.
+type MissingRecordMetricsRecorder interface {
+	MissingRecordStored(label string)
+}
+
+// LabeledRefreshBufferMetricsRecorder works like RefreshBufferMetricsRecorder,
+// but includes the label of the batch group that the buffer belongs to.
+type LabeledRefreshBufferMetricsRecorder interface {
+	LabeledRefreshBufferFlushed(label string, reason BufferFlushReason, fillRatio float64)
+}
+
+// metricsLabel returns the label of the key, or an empty string if WithMetricsLabeler hasn't been used.
+func metricsLabel(labeler func(key string) string, key string) string {
+	if labeler == nil {
+		return ""
+	}
+	return labeler(key)
+}
+
+func (c *Client) reportFetch(key string, duration time.Duration) {
+	if recorder, ok := c.metricsRecorder.(FetchMetricsRecorder); ok {
+		recorder.FetchDuration(metricsLabel(c.metricsLabeler, key), duration)
+	}
+}
+
+// reportRefresh counts a background refresh, and reports its outcome.
+func (c *Client) reportRefresh(key string, duration time.Duration, err error) {
+	outcome := RefreshSucceeded
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrNotModified):
+		outcome = RefreshNotModified
+	case ErrIsStoreMissingRecordOrMissingRecord(err):
+		outcome = RefreshMissingRecord
+	default:
+		outcome = RefreshFailed
+	}
+
+	c.stats.refreshes.Add(1)
+	if outcome == RefreshFailed {
+		c.stats.refreshErrors.Add(1)
+	}
+	if recorder, ok := c.metricsRecorder.(RefreshMetricsRecorder); ok {
+		recorder.RefreshCompleted(metricsLabel(c.metricsLabeler, key), duration, outcome)
+	}
+}
+
+// reportMissingRecordStored should be called WITH a lock when a missing record has been written to the shard.
+func (s *shard) reportMissingRecordStored(key string) {
+	if recorder, ok := s.metricsRecorder.(MissingRecordMetricsRecorder); ok {
+		recorder.MissingRecordStored(metricsLabel(s.metricsLabeler, key))
+	}
+}
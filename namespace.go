@@ -0,0 +1,84 @@
+package sturdyc
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// namespaceEscaper escapes the separator in namespaces, which ensures that
+// the first unescaped separator of a namespaced key is the one that ends the
+// namespace. Otherwise, a namespace like "a-g0" could produce the same keys
+// as the namespace "a".
+var namespaceEscaper = strings.NewReplacer(`\`, `\\`, "-", `\-`)
+
+// namespaceGeneration returns the generation counter of the namespace.
+func (c *Client) namespaceGeneration(namespace string) *atomic.Uint64 {
+	if generation, ok := c.namespaces.Load(namespace); ok {
+		counter, _ := generation.(*atomic.Uint64)
+		return counter
+	}
+	generation, _ := c.namespaces.LoadOrStore(namespace, new(atomic.Uint64))
+	counter, _ := generation.(*atomic.Uint64)
+	return counter
+}
+
+// NamespacePrefix returns the prefix that NamespacedKey writes in front of
+// the keys of the namespace's current generation. It can be passed to Keys
+// and Scan, or be followed by a "*" in DeleteMatching, without having to know
+// how the namespace is escaped.
+func (c *Client) NamespacePrefix(namespace string) string {
+	generation := c.namespaceGeneration(namespace).Load()
+	return namespaceEscaper.Replace(namespace) + "-g" + strconv.FormatUint(generation, 10) + "-"
+}
+
+// NamespacedKey prefixes the key with the namespace, and its current
+// generation. Bumping the namespace makes every key that was created before
+// the bump unreachable. Backslashes and dashes in the namespace are escaped
+// with a backslash.
+func (c *Client) NamespacedKey(namespace, key string) string {
+	return c.NamespacePrefix(namespace) + key
+}
+
+// BumpNamespace increments the generation of the namespace, which logically
+// invalidates all of its entries in constant time. The entries that can no
+// longer be reached are removed as they expire. Fetches and refreshes that are
+// in flight while the namespace is bumped write their responses to the keys of
+// the previous generation, which are unreachable as well. Returns the new
+// generation of the namespace.
+func (c *Client) BumpNamespace(namespace string) uint64 {
+	return c.namespaceGeneration(namespace).Add(1)
+}
+
+// namespacedKeyFn prefixes the keys of another KeyFunc with a namespace.
+type namespacedKeyFn struct {
+	client    *Client
+	namespace string
+	keyFn     KeyFunc
+}
+
+func (n namespacedKeyFn) Key(id string) string {
+	return n.client.NamespacedKey(n.namespace, n.keyFn.Key(id))
+}
+
+// namespacedGroupKeyFn prefixes the keys and the group of a GroupKeyFunc with a namespace.
+type namespacedGroupKeyFn struct {
+	namespacedKeyFn
+	groupKeyFn GroupKeyFunc
+}
+
+func (n namespacedGroupKeyFn) Group() string {
+	return n.client.NamespacedKey(n.namespace, n.groupKeyFn.Group())
+}
+
+// NamespacedKeyFn wraps the key function so that every key is prefixed with
+// the namespace, and its current generation. If the key function is a
+// GroupKeyFunc, the returned function is one as well, which allows the
+// refreshes to be buffered by the group of the namespace.
+func (c *Client) NamespacedKeyFn(namespace string, keyFn KeyFunc) KeyFunc {
+	namespaced := namespacedKeyFn{client: c, namespace: namespace, keyFn: keyFn}
+	if groupKeyFn, ok := keyFn.(GroupKeyFunc); ok {
+		return namespacedGroupKeyFn{namespacedKeyFn: namespaced, groupKeyFn: groupKeyFn}
+	}
+	return namespaced
+}
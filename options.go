@@ -12,6 +12,16 @@ func WithMetrics(recorder MetricsRecorder) Option {
 	}
 }
 
+// WithMetricsLabeler derives the labels that are passed to the optional
+// metrics interfaces, such as FetchMetricsRecorder, from the keys. It's
+// typically used to map the prefix of a key to the endpoint that it belongs
+// to. The labeler is called frequently, and should be cheap.
+func WithMetricsLabeler(labeler func(key string) string) Option {
+	return func(c *Client) {
+		c.metricsLabeler = labeler
+	}
+}
+
 // WithClock can be used to change the clock that the cache uses. This is useful for testing.
 func WithClock(clock Clock) Option {
 	return func(c *Client) {
@@ -26,6 +36,16 @@ func WithEvictionInterval(interval time.Duration) Option {
 	}
 }
 
+// WithEvictionHook sets a function that is called for every entry that is
+// removed from the cache, along with the reason for its removal. The hook is
+// called while holding the lock of the shard, which means that it has to be
+// fast, and that it must not call any methods on the client.
+func WithEvictionHook(hook func(key string, value any, reason EvictionReason)) Option {
+	return func(c *Client) {
+		c.evictionHook = hook
+	}
+}
+
 func WithStampedeProtection(
 	minRefreshTime,
 	maxRefreshTime,
@@ -41,19 +61,220 @@ func WithStampedeProtection(
 	}
 }
 
+// WithXFetchRefreshStrategy replaces the uniformly random refresh times of the
+// stampede protection with probabilistic early refreshes based on the XFetch
+// algorithm. Entries become eligible for a refresh after the min refresh time,
+// and every read after that triggers a refresh with a probability that rises
+// as the max refresh time approaches. The probability is weighted by how long
+// it took to fetch the value, which means that entries that are expensive to
+// fetch are refreshed earlier. A beta greater than 1 favors earlier refreshes,
+// and a beta less than 1 favors later ones. It requires WithStampedeProtection.
+func WithXFetchRefreshStrategy(beta float64) Option {
+	return func(c *Client) {
+		c.refreshStrategy = refreshStrategyXFetch
+		c.xfetchBeta = beta
+	}
+}
+
+// WithRefreshPopularityThreshold makes the cache skip refreshes for entries
+// that are rarely read. An entry is only refreshed if it has been accessed
+// at least minAccesses times within the window. Cold entries keep being
+// served until they expire, at which point they're fetched again on demand.
+// A window of zero counts every access since the entry was written.
+func WithRefreshPopularityThreshold(minAccesses int, window time.Duration) Option {
+	return func(c *Client) {
+		c.minAccesses = int64(minAccesses)
+		c.accessWindow = window
+	}
+}
+
+// WithProactiveRefreshes starts a scheduler that refreshes the topK most
+// accessed entries before they become due for a refresh, rather than waiting
+// for a read to trigger it. The scheduler runs on the given interval, and
+// picks among the entries that are due for a refresh before its next run.
+// Only entries that were fetched through GetFetch or GetFetchBatch can be
+// refreshed proactively. It requires WithStampedeProtection, and respects
+// the threshold of WithRefreshPopularityThreshold.
+func WithProactiveRefreshes(topK int, interval time.Duration) Option {
+	return func(c *Client) {
+		c.proactiveRefreshTopK = topK
+		c.proactiveRefreshInterval = interval
+	}
+}
+
+// WithChangeAwareRefreshes makes the refresh interval adapt to how often the
+// values change. Every time a refresh returns a value that is equal to the
+// one in the cache, the time until the next refresh is doubled, up to the
+// max refresh interval. When a refresh returns a new value, the interval is
+// halved until it's back at the intervals of the stampede protection. The
+// values are compared using equalFn. If it's nil, the cache is going to use
+// an Equal method on the values, such as func (v T) Equal(other T) bool.
+// Values that can't be compared are always considered to have changed.
+// The max refresh interval should be kept below the TTL.
+func WithChangeAwareRefreshes(maxRefreshInterval time.Duration, equalFn func(a, b any) bool) Option {
+	return func(c *Client) {
+		c.maxRefreshInterval = maxRefreshInterval
+		c.equalFn = equalFn
+	}
+}
+
 func WithRefreshBuffering(batchSize int, maxBufferTime time.Duration) Option {
+	config := fixedBufferConfig(batchSize, maxBufferTime)
+	return func(c *Client) {
+		c.bufferConfig = config
+	}
+}
+
+// WithPrefixRefreshBuffering configures the refresh buffering for every batch
+// group that starts with the given prefix, e.g. the prefix that was passed to
+// BatchKeyFn or PermutatedBatchKeyFn. It takes precedence over the settings
+// of WithRefreshBuffering, and if several prefixes match a batch group the
+// longest one is used.
+func WithPrefixRefreshBuffering(prefix string, batchSize int, maxBufferTime time.Duration) Option {
+	config := fixedBufferConfig(batchSize, maxBufferTime)
+	return func(c *Client) {
+		c.prefixBufferConfigs[prefix] = config
+	}
+}
+
+func fixedBufferConfig(batchSize int, maxBufferTime time.Duration) bufferConfig {
+	if batchSize <= 0 {
+		panic("batch size must be greater than 0")
+	}
+	if maxBufferTime <= 0 {
+		panic("buffer time must be greater than 0")
+	}
+	return bufferConfig{
+		enabled:       true,
+		maxBufferSize: batchSize,
+		bufferTimeout: maxBufferTime,
+		adaptive:      nil,
+	}
+}
+
+// WithoutPrefixRefreshBuffering disables refresh buffering for every batch
+// group that starts with the given prefix. The refreshes for these groups
+// are going to be performed straight away.
+func WithoutPrefixRefreshBuffering(prefix string) Option {
+	return func(c *Client) {
+		//nolint: exhaustruct // The buffer size and timeout are unused.
+		c.prefixBufferConfigs[prefix] = bufferConfig{enabled: false}
+	}
+}
+
+// WithKeyEncoding sets the encoding that PermutatedKey, and the batch key
+// functions, use for the values of the permutation fields.
+func WithKeyEncoding(encoding KeyEncoding) Option {
+	return func(c *Client) {
+		c.keyEncoding = encoding
+	}
+}
+
+// WithHashedPermutationKeys replaces the permutation portion of the keys that
+// are created by PermutatedKey, and PermutatedBatchKeyFn, with a 128-bit hash
+// once it's at least minLength bytes long. The prefix, and the ID suffix of
+// batch keys, are kept as they are. Therefore, prefix based operations and
+// the grouping of buffered refreshes continue to work. The hashes are marked
+// with "hash:", or `\hash:` when KeyEncodingEscaped is used. Only the escaped
+// marker guarantees that a hash can't equal the values of another permutation.
+func WithHashedPermutationKeys(minLength int) Option {
+	if minLength < 1 {
+		panic("minLength must be greater than 0")
+	}
 	return func(c *Client) {
-		c.bufferRefreshes = true
-		c.maxBufferSize = batchSize
-		c.bufferTimeout = maxBufferTime
-		c.bufferIdentifierIDs = make(map[string][]string)
-		c.bufferIdentifierChans = make(map[string]chan<- []string)
+		c.keyHashThreshold = minLength
 	}
 }
 
 func WithRelativeTimeKeyFormat(truncation time.Duration) Option {
 	return func(c *Client) {
 		c.useRelativeTimeKeyFormat = true
-		c.keyTruncation = truncation
+		c.keyTimeBucket = TruncateBucket(truncation)
+	}
+}
+
+// WithRelativeTimeBucketKeyFormat works like WithRelativeTimeKeyFormat, but
+// uses calendar aware buckets, such as DayBucket, instead of a fixed duration.
+// The keys hold the distance between the bucket of the time, and the bucket
+// of the current time. Therefore, every key changes as the clock moves into
+// the next bucket, which happens at the same moment for all of them.
+func WithRelativeTimeBucketKeyFormat(bucket TimeBucket) Option {
+	return func(c *Client) {
+		c.useRelativeTimeKeyFormat = true
+		c.keyTimeBucket = bucket
+	}
+}
+
+// WithAbsoluteTimeBucketKeyFormat writes time fields as the start of the
+// bucket that they belong to. Unlike the relative formats, the keys don't
+// depend on the current time. Two times share a key for as long as they
+// belong to the same bucket, regardless of when the keys are created.
+func WithAbsoluteTimeBucketKeyFormat(bucket TimeBucket) Option {
+	return func(c *Client) {
+		c.useRelativeTimeKeyFormat = false
+		c.keyTimeBucket = bucket
+	}
+}
+
+// WithAdaptiveRefreshBuffering enables refresh buffering where the batch size
+// and buffer time adapt to the upstream. The cache measures the latency and
+// error rate of the batch refreshes for each batch group. While the average
+// latency stays below the target, the batch size grows and the buffer time
+// shrinks. If the upstream becomes slow, or starts to return errors, the
+// batch size is cut in half and the buffer time is extended instead.
+func WithAdaptiveRefreshBuffering(
+	minBatchSize,
+	maxBatchSize int,
+	minBufferTime,
+	maxBufferTime,
+	targetLatency time.Duration,
+) Option {
+	return func(c *Client) {
+		c.bufferConfig = adaptiveBufferConfig(minBatchSize, maxBatchSize, minBufferTime, maxBufferTime, targetLatency)
+	}
+}
+
+// WithPrefixAdaptiveRefreshBuffering enables adaptive refresh buffering for every
+// batch group that starts with the given prefix. See WithAdaptiveRefreshBuffering
+// and WithPrefixRefreshBuffering for more details.
+func WithPrefixAdaptiveRefreshBuffering(
+	prefix string,
+	minBatchSize,
+	maxBatchSize int,
+	minBufferTime,
+	maxBufferTime,
+	targetLatency time.Duration,
+) Option {
+	return func(c *Client) {
+		c.prefixBufferConfigs[prefix] = adaptiveBufferConfig(
+			minBatchSize, maxBatchSize, minBufferTime, maxBufferTime, targetLatency,
+		)
+	}
+}
+
+func adaptiveBufferConfig(
+	minBatchSize,
+	maxBatchSize int,
+	minBufferTime,
+	maxBufferTime,
+	targetLatency time.Duration,
+) bufferConfig {
+	if minBatchSize <= 0 || maxBatchSize < minBatchSize {
+		panic("batch sizes must be greater than 0, and max has to be greater than or equal to min")
+	}
+	if minBufferTime <= 0 || maxBufferTime < minBufferTime {
+		panic("buffer times must be greater than 0, and max has to be greater than or equal to min")
+	}
+	return bufferConfig{
+		enabled:       true,
+		maxBufferSize: maxBatchSize,
+		bufferTimeout: maxBufferTime,
+		adaptive: &adaptiveBounds{
+			minBatchSize:  minBatchSize,
+			maxBatchSize:  maxBatchSize,
+			minBufferTime: minBufferTime,
+			maxBufferTime: maxBufferTime,
+			targetLatency: targetLatency,
+		},
 	}
 }
@@ -0,0 +1,94 @@
+package sturdyc
+
+import (
+	"context"
+	"fmt"
+)
+
+// BatchStatus describes the outcome for one of the IDs of GetFetchBatchOrdered.
+type BatchStatus int
+
+const (
+	// BatchFound means that the record was either cached, or returned by the fetchFn.
+	BatchFound BatchStatus = iota
+	// BatchMissing means that the record doesn't exist. It wasn't returned by
+	// the fetchFn, or it's stored as a missing record.
+	BatchMissing
+	// BatchErrored means that the record wasn't cached, and that the call to
+	// the fetchFn failed.
+	BatchErrored
+)
+
+func (s BatchStatus) String() string {
+	switch s {
+	case BatchFound:
+		return "found"
+	case BatchMissing:
+		return "missing"
+	case BatchErrored:
+		return "errored"
+	}
+	return "unknown"
+}
+
+// BatchResult is the result for one of the IDs of GetFetchBatchOrdered.
+type BatchResult[T any] struct {
+	ID     string
+	Value  T
+	Status BatchStatus
+	// Err is the error that the fetchFn returned when the Status is BatchErrored.
+	Err error
+}
+
+// GetFetchBatchOrdered works like GetFetchBatch, but returns a result for
+// each of the IDs, in the order that they were passed in. IDs that occur more
+// than once are only sent to the fetchFn once, and get a result for each of
+// their positions. If the fetch fails, the error is the one that the fetchFn
+// returned. It's wrapped in ErrOnlyCachedRecords if some of the records were
+// cached.
+func GetFetchBatchOrdered[T any](
+	ctx context.Context,
+	client *Client,
+	ids []string,
+	keyFn KeyFunc,
+	fetchFn BatchFetchFn[T],
+) ([]BatchResult[T], error) {
+	seen := make(map[string]struct{}, len(ids))
+	uniqueIDs := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		uniqueIDs = append(uniqueIDs, id)
+	}
+
+	records, err := getFetchBatch(ctx, client, uniqueIDs, keyFn, fetchFn, nil)
+
+	results := make([]BatchResult[T], 0, len(ids))
+	for _, id := range ids {
+		//nolint: exhaustruct // The value is the zero value unless the record was found.
+		result := BatchResult[T]{ID: id, Status: BatchFound}
+		switch record, ok := records[id]; {
+		case ok:
+			result.Value = record
+		case err != nil && !client.isMissingRecord(keyFn.Key(id)):
+			result.Status = BatchErrored
+			result.Err = err
+		default:
+			result.Status = BatchMissing
+		}
+		results = append(results, result)
+	}
+
+	if err != nil && len(records) > 0 {
+		return results, fmt.Errorf("%w: %w", ErrOnlyCachedRecords, err)
+	}
+	return results, err
+}
+
+// isMissingRecord reports whether the key is stored as a missing record.
+func (c *Client) isMissingRecord(key string) bool {
+	_, info, ok := c.shards[c.shardIndex(key)].peek(key)
+	return ok && info.IsMissingRecord
+}
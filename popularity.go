@@ -0,0 +1,56 @@
+package sturdyc
+
+import "sort"
+
+// keyRefresher returns a function that refreshes the key, or nil if proactive refreshes are disabled.
+func keyRefresher[T any](c *Client, key string, fetchFn FetchFn[T]) func() {
+	if c.proactiveRefreshTopK < 1 {
+		return nil
+	}
+	return func() {
+		refresh(c, key, fetchFn)
+	}
+}
+
+// batchRefresher returns a function that refreshes the ID, or nil if
+// proactive refreshes are disabled. The refreshes go through the refresh
+// buffers, which allows IDs of the same batch group to share a fetch.
+func batchRefresher[T any](c *Client, id string, keyFn KeyFunc, fetchFn BatchFetchFn[T]) func() {
+	if c.proactiveRefreshTopK < 1 {
+		return nil
+	}
+	return func() {
+		bufferBatchRefresh(c, []string{id}, keyFn, fetchFn)
+	}
+}
+
+// startProactiveRefreshes is going to be running in a separate goroutine that we're going to prevent from ever exiting.
+func (c *Client) startProactiveRefreshes() {
+	go func() {
+		ticker, stop := c.clock.NewTicker(c.proactiveRefreshInterval)
+		defer stop()
+		for range ticker {
+			c.refreshHotEntries()
+		}
+	}()
+}
+
+// refreshHotEntries refreshes the most accessed entries that are going to
+// become due for a refresh before the next tick.
+func (c *Client) refreshHotEntries() {
+	horizon := c.clock.Now().Add(c.proactiveRefreshInterval)
+	candidates := make([]hotEntry, 0)
+	for _, shard := range c.shards {
+		candidates = append(candidates, shard.hotEntries(c.proactiveRefreshTopK, horizon)...)
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accesses > candidates[j].accesses
+	})
+
+	for _, candidate := range candidates[:min(c.proactiveRefreshTopK, len(candidates))] {
+		if candidate.shard.claimRefresh(candidate.entry, horizon) {
+			safeGo(candidate.entry.refresher)
+		}
+	}
+}
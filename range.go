@@ -0,0 +1,82 @@
+package sturdyc
+
+import (
+	"sort"
+	"strings"
+)
+
+// rangeEntry is a copy of an entry that was taken while holding the lock of the shard.
+type rangeEntry struct {
+	key   string
+	value any
+	info  EntryInfo
+}
+
+// snapshot copies the entries that haven't expired, and whose keys begin with the prefix.
+func (s *shard) snapshot(prefix string) []rangeEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.clock.Now()
+	entries := make([]rangeEntry, 0, len(s.entries))
+	for key, e := range s.entries {
+		if now.After(e.expiresAt) || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := rangeEntry{key: key, value: e.value, info: EntryInfo{}}
+		s.populateInfo(&entry.info, e)
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// rangePrefix calls fn for every entry whose key begins with the prefix. The
+// shards are copied one at a time, which means that we never hold more than
+// one lock, and that fn is free to call other methods on the client.
+func (c *Client) rangePrefix(prefix string, fn func(entry rangeEntry) bool) {
+	for _, shard := range c.shards {
+		for _, entry := range shard.snapshot(prefix) {
+			if !fn(entry) {
+				return
+			}
+		}
+	}
+}
+
+// Range calls fn for every entry in the cache that hasn't expired, until fn
+// returns false. Entries that are written while we're iterating may or may
+// not be visited. Unlike Get, it doesn't record any metrics, or access
+// statistics, for the entries.
+func (c *Client) Range(fn func(key string, value any, info EntryInfo) bool) {
+	c.rangePrefix("", func(entry rangeEntry) bool {
+		return fn(entry.key, entry.value, entry.info)
+	})
+}
+
+// Keys returns the sorted keys of the entries that haven't expired, and
+// that begin with the prefix. An empty prefix returns every key.
+func (c *Client) Keys(prefix string) []string {
+	keys := make([]string, 0)
+	c.rangePrefix(prefix, func(entry rangeEntry) bool {
+		keys = append(keys, entry.key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// Scan calls fn for every entry that begins with the prefix, and holds a
+// value of type T, until fn returns false. Expired entries, and records
+// that were stored as missing, are skipped.
+func Scan[T any](c *Client, prefix string, fn func(key string, value T, info EntryInfo) bool) {
+	c.rangePrefix(prefix, func(entry rangeEntry) bool {
+		if entry.info.IsMissingRecord {
+			return true
+		}
+		value, ok := entry.value.(T)
+		if !ok {
+			return true
+		}
+		return fn(entry.key, value, entry.info)
+	})
+}
@@ -0,0 +1,25 @@
+//go:build go1.23
+
+package sturdyc
+
+import "iter"
+
+// All returns an iterator over the entries in the cache that haven't expired.
+// See Range for the guarantees that are given while iterating.
+func (c *Client) All() iter.Seq2[string, any] {
+	return func(yield func(string, any) bool) {
+		c.Range(func(key string, value any, _ EntryInfo) bool {
+			return yield(key, value)
+		})
+	}
+}
+
+// ScanSeq returns an iterator over the entries that begin with the prefix,
+// and hold a value of type T. See Scan for the entries that are skipped.
+func ScanSeq[T any](c *Client, prefix string) iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		Scan(c, prefix, func(key string, value T, _ EntryInfo) bool {
+			return yield(key, value)
+		})
+	}
+}
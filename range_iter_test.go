@@ -0,0 +1,47 @@
+//go:build go1.23
+
+package sturdyc_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/creativecreature/sturdyc"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIterators(t *testing.T) {
+	t.Parallel()
+
+	client := sturdyc.New(100, 2, time.Hour, 10)
+	sturdyc.Set(client, "user-1", 1)
+	sturdyc.Set(client, "user-2", "two")
+	sturdyc.Set(client, "order-1", 1)
+
+	all := make(map[string]any)
+	for key, value := range client.All() {
+		all[key] = value
+	}
+	wantAll := map[string]any{"user-1": 1, "user-2": "two", "order-1": 1}
+	if !cmp.Equal(wantAll, all) {
+		t.Error(cmp.Diff(wantAll, all))
+	}
+
+	scanned := make(map[string]int)
+	for key, value := range sturdyc.ScanSeq[int](client, "user-") {
+		scanned[key] = value
+	}
+	wantScanned := map[string]int{"user-1": 1}
+	if !cmp.Equal(wantScanned, scanned) {
+		t.Error(cmp.Diff(wantScanned, scanned))
+	}
+
+	var visited int
+	for range client.All() {
+		visited++
+		break
+	}
+	if visited != 1 {
+		t.Errorf("expected the iteration to stop after 1 entry, got %d", visited)
+	}
+}
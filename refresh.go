@@ -3,27 +3,66 @@ package sturdyc
 import (
 	"context"
 	"errors"
+	"sort"
+	"strings"
 	"time"
 )
 
+// refreshStrategy determines how the cache decides when an entry should be refreshed.
+type refreshStrategy int
+
+const (
+	// refreshStrategyUniform refreshes the entry at a random time between the min and max refresh time.
+	refreshStrategyUniform refreshStrategy = iota
+	// refreshStrategyXFetch refreshes the entry early with a probability that
+	// increases as the max refresh time approaches. See WithXFetchRefreshStrategy.
+	refreshStrategyXFetch
+)
+
 func refresh[T any](client *Client, key string, fetchFn FetchFn[T]) {
+	token, release := client.writeToken(key)
+	defer release()
+	start := client.clock.Now()
 	response, err := fetchFn(context.Background())
+	fetchDuration := client.clock.Now().Sub(start)
+	client.reportRefresh(key, fetchDuration, err)
 	if err != nil {
 		// Check if it is a missing record, and if we should store it with a cooldown.
 		if client.storeMisses && errors.Is(err, ErrStoreMissingRecord) {
-			client.set(key, response, true)
+			client.setRefreshed(key, write{
+				value:           response,
+				isMissingRecord: true,
+				fetchDuration:   fetchDuration,
+				refresher:       keyRefresher(client, key, fetchFn),
+				validator:       "",
+				token:           token,
+			})
 		}
 		return
 	}
-	client.set(key, response, false)
+	client.setRefreshed(key, write{
+		value:           response,
+		isMissingRecord: false,
+		fetchDuration:   fetchDuration,
+		refresher:       keyRefresher(client, key, fetchFn),
+		validator:       "",
+		token:           token,
+	})
 }
 
-func refreshBatch[T any](client *Client, ids []string, keyFn KeyFn, fetchFn BatchFetchFn[T]) {
+func refreshBatch[T any](client *Client, ids []string, keyFn KeyFunc, fetchFn BatchFetchFn[T]) {
 	if client.metricsRecorder != nil {
 		client.metricsRecorder.CacheBatchRefreshSize(len(ids))
 	}
 
+	keys := newBatchKeys(keyFn, ids)
+	tokens, release := client.batchWriteTokens(keys, ids)
+	defer release()
+	start := client.clock.Now()
 	response, err := fetchFn(context.Background(), ids)
+	fetchDuration := client.clock.Now().Sub(start)
+	client.observeBatchRefresh(keyFn, fetchDuration, err)
+	client.reportRefresh(keys.key(ids[0]), fetchDuration, err)
 	if err != nil {
 		return
 	}
@@ -31,30 +70,232 @@ func refreshBatch[T any](client *Client, ids []string, keyFn KeyFn, fetchFn Batc
 	if client.storeMisses && len(response) < len(ids) {
 		for _, id := range ids {
 			if v, ok := response[id]; !ok {
-				client.set(keyFn(id), v, true)
+				key := keys.key(id)
+				client.setRefreshed(key, write{
+					value:           v,
+					isMissingRecord: true,
+					fetchDuration:   fetchDuration,
+					refresher:       batchRefresher(client, id, keyFn, fetchFn),
+					validator:       "",
+					token:           tokens.token(client, key),
+				})
 			}
 		}
 	}
 
 	// Cache the refreshed records.
 	for id, record := range response {
-		client.set(keyFn(id), record, false)
+		key := keys.key(id)
+		client.setRefreshed(key, write{
+			value:           record,
+			isMissingRecord: false,
+			fetchDuration:   fetchDuration,
+			refresher:       batchRefresher(client, id, keyFn, fetchFn),
+			validator:       "",
+			token:           tokens.token(client, key),
+		})
+	}
+}
+
+// bufferConfig holds the refresh buffering settings for a batch group.
+type bufferConfig struct {
+	enabled       bool
+	maxBufferSize int
+	bufferTimeout time.Duration
+	// adaptive is set when the batch size and buffer
+	// timeout should adapt to the upstream's latency.
+	adaptive *adaptiveBounds
+}
+
+// matchesGroup reports whether the prefix matches the beginning of the batch
+// group. The prefix has to be followed by a separator, which prevents a prefix
+// such as "order" from matching the keys of "orders".
+func matchesGroup(group, prefix string) bool {
+	if !strings.HasPrefix(group, prefix) {
+		return false
+	}
+	if len(group) == len(prefix) || strings.HasSuffix(prefix, "-") {
+		return true
+	}
+	return group[len(prefix)] == '-'
+}
+
+// bufferConfigFor returns the buffering settings that should be used for the
+// next buffer of the batch group.
+func (c *Client) bufferConfigFor(group string) bufferConfig {
+	cfg := c.baseBufferConfig(group)
+	if !cfg.enabled || cfg.adaptive == nil {
+		return cfg
+	}
+	return c.adaptiveBuffers.config(group, *cfg.adaptive, c.clock.Now(), c.ttl)
+}
+
+// baseBufferConfig returns the configured buffering settings for the batch group.
+// The longest matching prefix wins, and we'll fall back to the client's settings.
+func (c *Client) baseBufferConfig(group string) bufferConfig {
+	cfg := c.bufferConfig
+	longestMatch := -1
+	for prefix, prefixCfg := range c.prefixBufferConfigs {
+		if len(prefix) > longestMatch && matchesGroup(group, prefix) {
+			cfg = prefixCfg
+			longestMatch = len(prefix)
+		}
+	}
+	return cfg
+}
+
+// refreshBuffer holds the IDs of a batch group that are waiting to be refreshed.
+type refreshBuffer struct {
+	ids           []string
+	maxBufferSize int
+	createdAt     time.Time
+	channel       chan<- []string
+	// flush is closed to make the buffer refresh its IDs straight away, and
+	// done is closed once the refresh of the buffered IDs has completed.
+	flush    chan struct{}
+	flushing bool
+	done     chan struct{}
+}
+
+// RefreshBufferInfo describes a batch group with IDs waiting to be refreshed.
+type RefreshBufferInfo struct {
+	Group     string
+	Size      int
+	BatchSize int
+	Age       time.Duration
+}
+
+// RefreshBuffers returns the refresh buffers that are currently waiting for
+// more IDs, or for their timeout to expire, sorted by their group.
+func (c *Client) RefreshBuffers() []RefreshBufferInfo {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
+
+	now := c.clock.Now()
+	buffers := make([]RefreshBufferInfo, 0, len(c.refreshBuffers))
+	for group, buffer := range c.refreshBuffers {
+		buffers = append(buffers, RefreshBufferInfo{
+			Group:     group,
+			Size:      len(buffer.ids),
+			BatchSize: buffer.maxBufferSize,
+			Age:       now.Sub(buffer.createdAt),
+		})
+	}
+	sort.Slice(buffers, func(i, j int) bool {
+		return buffers[i].Group < buffers[j].Group
+	})
+	return buffers
+}
+
+// FlushRefreshBuffers refreshes the IDs of every pending refresh buffer
+// without waiting for the buffers to fill up or time out. It blocks until
+// the refreshes have completed, or returns the context's error if it's
+// cancelled before that. Batches that were refreshed because they reached
+// the batch size are waited for as well, and the buffers that are created
+// for their overflowing IDs are flushed too.
+func (c *Client) FlushRefreshBuffers(ctx context.Context) error {
+	for {
+		c.bufferMutex.Lock()
+		pending := make([]chan struct{}, 0, len(c.refreshBuffers)+1)
+		for _, buffer := range c.refreshBuffers {
+			if !buffer.flushing {
+				buffer.flushing = true
+				close(buffer.flush)
+			}
+			pending = append(pending, buffer.done)
+		}
+		if c.bufferedRefreshes > 0 {
+			pending = append(pending, c.bufferedRefreshesDone)
+		}
+		c.bufferMutex.Unlock()
+
+		if len(pending) == 0 {
+			return nil
+		}
+
+		for _, done := range pending {
+			select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// startBufferedRefresh should be called WITHOUT a lock before a refresh, or
+// re-buffering, that runs outside of a refresh buffer is started.
+func (c *Client) startBufferedRefresh() {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
+	if c.bufferedRefreshes == 0 {
+		c.bufferedRefreshesDone = make(chan struct{})
 	}
+	c.bufferedRefreshes++
+}
+
+// finishBufferedRefresh should be called WITHOUT a lock once a refresh that
+// was started with startBufferedRefresh has completed.
+func (c *Client) finishBufferedRefresh() {
+	c.bufferMutex.Lock()
+	defer c.bufferMutex.Unlock()
+	c.bufferedRefreshes--
+	if c.bufferedRefreshes == 0 {
+		close(c.bufferedRefreshesDone)
+	}
+}
+
+// goBufferedRefresh runs fn in a new goroutine that FlushRefreshBuffers waits for.
+func (c *Client) goBufferedRefresh(fn func()) {
+	c.startBufferedRefresh()
+	safeGo(func() {
+		defer c.finishBufferedRefresh()
+		fn()
+	})
 }
 
 // deleteRefreshBuffer should be called WITH a lock when a buffer has been processed.
 func deleteRefreshBuffer(c *Client, batchIdentifier string) {
-	delete(c.bufferIdentifierChans, batchIdentifier)
-	delete(c.bufferIdentifierIDs, batchIdentifier)
+	delete(c.refreshBuffers, batchIdentifier)
+}
+
+func (c *Client) reportBufferFlush(group string, reason BufferFlushReason, size, maxBufferSize int) {
+	c.stats.bufferedBatches.Add(1)
+	fillRatio := min(float64(size)/float64(maxBufferSize), 1)
+	if recorder, ok := c.metricsRecorder.(RefreshBufferMetricsRecorder); ok {
+		recorder.RefreshBufferFlushed(reason, fillRatio)
+	}
+	if recorder, ok := c.metricsRecorder.(LabeledRefreshBufferMetricsRecorder); ok {
+		recorder.LabeledRefreshBufferFlushed(metricsLabel(c.metricsLabeler, group), reason, fillRatio)
+	}
 }
 
-func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFn, fetchFn BatchFetchFn[T]) {
+func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFunc, fetchFn BatchFetchFn[T]) {
 	if len(ids) == 0 {
 		return
 	}
 
+	// Without a group we have no way of telling which IDs that can be
+	// fetched together, so we'll have to refresh the records immediately.
+	groupKeyFn, ok := keyFn.(GroupKeyFunc)
+	if !ok {
+		refreshBatch(c, ids, keyFn, fetchFn)
+		return
+	}
+
+	// The group uniquely identifies the records that can be refreshed together.
+	keyPrefix := groupKeyFn.Group()
+	cfg := c.bufferConfigFor(keyPrefix)
+	if !cfg.enabled {
+		refreshBatch(c, ids, keyFn, fetchFn)
+		return
+	}
+
 	// If we got a perfect batch size, we can refresh the records immediately.
-	if len(ids) == c.maxBufferSize {
+	if len(ids) == cfg.maxBufferSize {
+		c.reportBufferFlush(keyPrefix, BufferFlushSize, len(ids), cfg.maxBufferSize)
+		c.startBufferedRefresh()
+		defer c.finishBufferedRefresh()
 		refreshBatch(c, ids, keyFn, fetchFn)
 		return
 	}
@@ -63,33 +304,32 @@ func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFn, fetchFn Bat
 
 	// If the ids are greater than our ideal buffer size we'll refresh
 	// some of them, and create a new buffer for the remainder.
-	if len(ids) > c.maxBufferSize {
-		idsToRefresh, overflowingIDs := ids[:c.maxBufferSize], ids[c.maxBufferSize:]
+	if len(ids) > cfg.maxBufferSize {
+		idsToRefresh, overflowingIDs := ids[:cfg.maxBufferSize], ids[cfg.maxBufferSize:]
 		c.bufferMutex.Unlock()
-		safeGo(func() {
+		c.reportBufferFlush(keyPrefix, BufferFlushSize, len(idsToRefresh), cfg.maxBufferSize)
+		c.goBufferedRefresh(func() {
 			refreshBatch(c, idsToRefresh, keyFn, fetchFn)
 		})
-		safeGo(func() {
+		c.goBufferedRefresh(func() {
 			bufferBatchRefresh(c, overflowingIDs, keyFn, fetchFn)
 		})
 		return
 	}
 
-	// Extract the cache key prefix that uniquely identifies this group of records.
-	keyPrefix := extractPermutation(keyFn(ids[0]))
-
 	// Check if we already have a batch waiting to be refreshed.
-	if channel, ok := c.bufferIdentifierChans[keyPrefix]; ok {
+	if buffer, ok := c.refreshBuffers[keyPrefix]; ok {
 		// There is a small chance that another goroutine manages to write to the channel
 		// and fill the buffer as we unlock this mutex. Therefore, we'll add a timer so
 		// that we can process these ids again if that were to happen.
+		channel := buffer.channel
 		c.bufferMutex.Unlock()
 		timer, stop := c.clock.NewTimer(time.Millisecond * 10)
 		select {
 		case channel <- ids:
 			stop()
 		case <-timer:
-			safeGo(func() {
+			c.goBufferedRefresh(func() {
 				bufferBatchRefresh(c, ids, keyFn, fetchFn)
 			})
 			return
@@ -99,12 +339,21 @@ func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFn, fetchFn Bat
 
 	// There is no existing batch buffering for this key, so we'll create a new one.
 	newChannel := make(chan []string)
-	c.bufferIdentifierChans[keyPrefix] = newChannel
-	c.bufferIdentifierIDs[keyPrefix] = ids
+	flush := make(chan struct{})
+	done := make(chan struct{})
+	c.refreshBuffers[keyPrefix] = &refreshBuffer{
+		ids:           ids,
+		maxBufferSize: cfg.maxBufferSize,
+		createdAt:     c.clock.Now(),
+		channel:       newChannel,
+		flush:         flush,
+		flushing:      false,
+		done:          done,
+	}
 
 	safeGo(func() {
 		c.bufferMutex.Unlock()
-		timer, stop := c.clock.NewTimer(c.bufferTimeout)
+		timer, stop := c.clock.NewTimer(cfg.bufferTimeout)
 
 		for {
 			select {
@@ -115,24 +364,42 @@ func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFn, fetchFn Bat
 				}
 
 				c.bufferMutex.Lock()
-				idsToRefresh := c.bufferIdentifierIDs[keyPrefix]
+				idsToRefresh := c.refreshBuffers[keyPrefix].ids
 				deleteRefreshBuffer(c, keyPrefix)
 				c.bufferMutex.Unlock()
+				c.reportBufferFlush(keyPrefix, BufferFlushTimeout, len(idsToRefresh), cfg.maxBufferSize)
 				safeGo(func() {
+					defer close(done)
 					refreshBatch(c, idsToRefresh, keyFn, fetchFn)
 				})
 				return
 
+			// The buffer is being flushed manually. We'll stop the timer and refresh the records straight away.
+			case <-flush:
+				if !stop() {
+					<-timer
+				}
+
+				c.bufferMutex.Lock()
+				idsToRefresh := c.refreshBuffers[keyPrefix].ids
+				deleteRefreshBuffer(c, keyPrefix)
+				c.bufferMutex.Unlock()
+				c.reportBufferFlush(keyPrefix, BufferFlushManual, len(idsToRefresh), cfg.maxBufferSize)
+				defer close(done)
+				refreshBatch(c, idsToRefresh, keyFn, fetchFn)
+				return
+
 			case newIDs, ok := <-newChannel:
 				if !ok {
 					return
 				}
 
 				c.bufferMutex.Lock()
-				c.bufferIdentifierIDs[keyPrefix] = append(c.bufferIdentifierIDs[keyPrefix], newIDs...)
+				buffer := c.refreshBuffers[keyPrefix]
+				buffer.ids = append(buffer.ids, newIDs...)
 
 				// If we haven't reached the buffer size yet, we'll wait for more ids.
-				if len(c.bufferIdentifierIDs[keyPrefix]) < c.maxBufferSize {
+				if len(buffer.ids) < cfg.maxBufferSize {
 					c.bufferMutex.Unlock()
 					continue
 				}
@@ -142,15 +409,19 @@ func bufferBatchRefresh[T any](c *Client, ids []string, keyFn KeyFn, fetchFn Bat
 					<-timer
 				}
 
-				allIDs := c.bufferIdentifierIDs[keyPrefix]
+				allIDs := buffer.ids
 				deleteRefreshBuffer(c, keyPrefix)
 				c.bufferMutex.Unlock()
-				idsToRefresh, overflowingIDs := allIDs[:c.maxBufferSize], allIDs[c.maxBufferSize:]
-				safeGo(func() {
-					refreshBatch(c, idsToRefresh, keyFn, fetchFn)
+				idsToRefresh, overflowingIDs := allIDs[:cfg.maxBufferSize], allIDs[cfg.maxBufferSize:]
+				c.reportBufferFlush(keyPrefix, BufferFlushSize, len(idsToRefresh), cfg.maxBufferSize)
+				// The overflow is tracked before done is closed, so that
+				// FlushRefreshBuffers can't miss it in between.
+				c.goBufferedRefresh(func() {
+					bufferBatchRefresh(c, overflowingIDs, keyFn, fetchFn)
 				})
 				safeGo(func() {
-					bufferBatchRefresh(c, overflowingIDs, keyFn, fetchFn)
+					defer close(done)
+					refreshBatch(c, idsToRefresh, keyFn, fetchFn)
 				})
 				return
 			}
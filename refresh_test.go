@@ -2,12 +2,17 @@ package sturdyc_test
 
 import (
 	"context"
+	"errors"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/creativecreature/sturdyc"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestBatchIsRefreshedWhenTheTimeoutExpires(t *testing.T) {
@@ -383,3 +388,610 @@ func TestLargeBatchesAreChunkedCorrectly(t *testing.T) {
 	}
 	fetchObserver.AssertFetchCount(t, 11)
 }
+
+func TestBatchesAreGroupedWhenIDsContainTheSeparator(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	batchSize := 3
+	batchBufferTimeout := time.Minute
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshBuffering(batchSize, batchBufferTimeout),
+		sturdyc.WithClock(clock),
+	)
+
+	// These IDs would have ended up in different groups if
+	// we tried to derive the group from the cache key.
+	ids := []string{"ID-1", "2", "x-ID-3"}
+	fetchObserver := NewFetchObserver(1)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 1)
+	fetchObserver.Clear()
+
+	clock.Add(maxRefreshDelay + time.Second)
+
+	// Request the IDs one by one. They should all end up in the same buffer,
+	// and the third request should fill it and trigger the refresh.
+	fetchObserver.BatchResponse(ids)
+	for _, id := range ids {
+		sturdyc.GetFetchBatch(ctx, client, []string{id}, client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+		time.Sleep(5 * time.Millisecond)
+	}
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 2)
+	fetchObserver.AssertRequestedRecords(t, ids)
+}
+
+func TestRefreshesForUngroupedKeyFnsAreNotBuffered(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	batchSize := 10
+	batchBufferTimeout := time.Minute
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshBuffering(batchSize, batchBufferTimeout),
+		sturdyc.WithClock(clock),
+	)
+
+	keyFn := sturdyc.KeyFn(func(id string) string {
+		return "custom/" + id
+	})
+
+	ids := []string{"1", "2", "3"}
+	fetchObserver := NewFetchObserver(1)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, keyFn, fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 1)
+	fetchObserver.Clear()
+
+	// The key function doesn't expose a group. Hence, the refresh
+	// should happen straight away without waiting for the timeout.
+	clock.Add(maxRefreshDelay + time.Second)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, keyFn, fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 2)
+	fetchObserver.AssertRequestedRecords(t, ids)
+}
+
+func TestRefreshBuffersCanBeInspectedAndFlushed(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	batchSize := 10
+	batchBufferTimeout := time.Minute
+	clock := sturdyc.NewTestClock(time.Now())
+	metricsRecorder := newTestMetricsRecorder(numShards)
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshBuffering(batchSize, batchBufferTimeout),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+
+	ids := []string{"1", "2", "3", "4", "5"}
+	fetchObserver := NewFetchObserver(2)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("other"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	<-fetchObserver.FetchCompleted
+	fetchObserver.Clear()
+
+	// Request the records after the refresh delay, which
+	// should leave us with one pending buffer per group.
+	clock.Add(maxRefreshDelay + time.Second)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids[:2], client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+	sturdyc.GetFetchBatch(ctx, client, ids[:3], client.BatchKeyFn("other"), fetchObserver.FetchBatch)
+	time.Sleep(10 * time.Millisecond)
+	clock.Add(time.Second * 5)
+
+	buffers := client.RefreshBuffers()
+	want := []sturdyc.RefreshBufferInfo{
+		{Group: "item-", Size: 2, BatchSize: 10, Age: time.Second * 5},
+		{Group: "other-", Size: 3, BatchSize: 10, Age: time.Second * 5},
+	}
+	if !cmp.Equal(want, buffers) {
+		t.Fatal(cmp.Diff(want, buffers))
+	}
+
+	// Flushing the buffers should refresh both batches without moving the clock
+	// past the timeout, and the call shouldn't return until they've completed.
+	if err := client.FlushRefreshBuffers(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	fetchObserver.AssertFetchCount(t, 4)
+	if buffers := client.RefreshBuffers(); len(buffers) != 0 {
+		t.Errorf("expected no pending buffers, got %v", buffers)
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.bufferFlushes[sturdyc.BufferFlushManual] != 2 {
+		t.Errorf("expected 2 manual flushes, got %d", metricsRecorder.bufferFlushes[sturdyc.BufferFlushManual])
+	}
+	if !cmp.Equal([]float64{0.2, 0.3}, sortedFloats(metricsRecorder.fillRatios)) {
+		t.Errorf("unexpected fill ratios %v", metricsRecorder.fillRatios)
+	}
+}
+
+func TestFlushingRefreshBuffersWaitsForBatchesThatReachedTheBatchSize(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	maxRefreshDelay := time.Minute * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(1000, 10, time.Hour, 10,
+		sturdyc.WithStampedeProtection(time.Minute*5, maxRefreshDelay, time.Millisecond*10, true),
+		sturdyc.WithRefreshBuffering(2, time.Minute),
+		sturdyc.WithClock(clock),
+	)
+
+	var mu sync.Mutex
+	var refreshedIDs []string
+	refreshStarted := make(chan struct{})
+	releaseRefresh := make(chan struct{})
+	refreshing := false
+	fetchFn := func(_ context.Context, ids []string) (map[string]string, error) {
+		mu.Lock()
+		blocking := refreshing && len(ids) == 2
+		mu.Unlock()
+		// The batch that reached the batch size is blocked until we release it.
+		if blocking {
+			close(refreshStarted)
+			<-releaseRefresh
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		response := make(map[string]string, len(ids))
+		for _, id := range ids {
+			response[id] = "value"
+			if refreshing {
+				refreshedIDs = append(refreshedIDs, id)
+			}
+		}
+		return response, nil
+	}
+
+	ids := []string{"1", "2", "3"}
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	mu.Lock()
+	refreshing = true
+	mu.Unlock()
+
+	// Three IDs exceed the batch size of two. Two of them are refreshed straight
+	// away, while the last one is put in a buffer that waits for more IDs.
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	<-refreshStarted
+	for len(client.RefreshBuffers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	flushed := make(chan error)
+	go func() {
+		flushed <- client.FlushRefreshBuffers(ctx)
+	}()
+
+	select {
+	case err := <-flushed:
+		t.Fatalf("expected the flush to wait for the refresh, returned %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(releaseRefresh)
+	if err := <-flushed; err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	slices.Sort(refreshedIDs)
+	if !cmp.Equal(ids, refreshedIDs) {
+		t.Errorf("expected every id to be refreshed, got %v", refreshedIDs)
+	}
+}
+
+func TestRefreshBufferFlushReasonsAreReported(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	batchSize := 4
+	batchBufferTimeout := time.Minute
+	clock := sturdyc.NewTestClock(time.Now())
+	metricsRecorder := newTestMetricsRecorder(numShards)
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshBuffering(batchSize, batchBufferTimeout),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+	)
+
+	ids := []string{"1", "2", "3", "4", "5", "6"}
+	fetchObserver := NewFetchObserver(1)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.Clear()
+
+	// Requesting 6 records with a batch size of 4 should result in one size
+	// triggered refresh, and a buffer for the remaining 2 that times out.
+	clock.Add(maxRefreshDelay + time.Second)
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	time.Sleep(10 * time.Millisecond)
+	clock.Add(batchBufferTimeout + time.Second)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 3)
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	if metricsRecorder.bufferFlushes[sturdyc.BufferFlushSize] != 1 {
+		t.Errorf("expected 1 size flush, got %d", metricsRecorder.bufferFlushes[sturdyc.BufferFlushSize])
+	}
+	if metricsRecorder.bufferFlushes[sturdyc.BufferFlushTimeout] != 1 {
+		t.Errorf("expected 1 timeout flush, got %d", metricsRecorder.bufferFlushes[sturdyc.BufferFlushTimeout])
+	}
+	if !cmp.Equal([]float64{0.5, 1}, sortedFloats(metricsRecorder.fillRatios)) {
+		t.Errorf("unexpected fill ratios %v", metricsRecorder.fillRatios)
+	}
+}
+
+func TestRefreshBufferingCanBeConfiguredPerPrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithRefreshBuffering(10, time.Minute),
+		sturdyc.WithPrefixRefreshBuffering("pricing", 2, time.Hour),
+		sturdyc.WithPrefixRefreshBuffering("item", 5, time.Hour),
+		sturdyc.WithoutPrefixRefreshBuffering("order-status"),
+		sturdyc.WithClock(clock),
+	)
+
+	ids := []string{"1", "2", "3"}
+	prefixes := []string{"pricing", "order-status", "items"}
+	fetchObserver := NewFetchObserver(len(prefixes))
+	fetchObserver.BatchResponse(ids)
+	for _, prefix := range prefixes {
+		sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn(prefix), fetchObserver.FetchBatch)
+		<-fetchObserver.FetchCompleted
+	}
+	fetchObserver.Clear()
+	clock.Add(maxRefreshDelay + time.Second)
+
+	// The pricing prefix has a batch size of 2, which means
+	// that these IDs should be refreshed straight away.
+	fetchObserver.BatchResponse(ids)
+	sturdyc.GetFetchBatch(ctx, client, ids[:2], client.BatchKeyFn("pricing"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 4)
+	fetchObserver.AssertRequestedRecords(t, ids[:2])
+
+	// Buffering is disabled for the order status prefix.
+	sturdyc.GetFetchBatch(ctx, client, ids[:1], client.BatchKeyFn("order-status"), fetchObserver.FetchBatch)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 5)
+	fetchObserver.AssertRequestedRecords(t, ids[:1])
+
+	// The "item" prefix shouldn't match the keys for "items",
+	// which should be buffered using the default settings.
+	sturdyc.GetFetchBatch(ctx, client, ids[:1], client.BatchKeyFn("items"), fetchObserver.FetchBatch)
+	time.Sleep(10 * time.Millisecond)
+	fetchObserver.AssertFetchCount(t, 5)
+	buffers := client.RefreshBuffers()
+	if len(buffers) != 1 || buffers[0].Group != "items-" || buffers[0].BatchSize != 10 {
+		t.Fatalf("expected a buffer for items with a batch size of 10, got %v", buffers)
+	}
+
+	clock.Add(time.Minute + time.Second)
+	<-fetchObserver.FetchCompleted
+	fetchObserver.AssertFetchCount(t, 6)
+}
+
+func TestRefreshBufferingPanicsOnInvalidSettings(t *testing.T) {
+	t.Parallel()
+
+	assertPanic := func(name string, option func() sturdyc.Option) {
+		t.Helper()
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected %s to panic", name)
+			}
+		}()
+		sturdyc.New(100, 1, time.Hour, 5, option())
+	}
+
+	assertPanic("a batch size of 0", func() sturdyc.Option {
+		return sturdyc.WithRefreshBuffering(0, time.Minute)
+	})
+	assertPanic("a negative buffer time", func() sturdyc.Option {
+		return sturdyc.WithRefreshBuffering(10, -time.Minute)
+	})
+	assertPanic("a negative prefix batch size", func() sturdyc.Option {
+		return sturdyc.WithPrefixRefreshBuffering("item", -1, time.Minute)
+	})
+	assertPanic("a prefix buffer time of 0", func() sturdyc.Option {
+		return sturdyc.WithPrefixRefreshBuffering("item", 10, 0)
+	})
+}
+
+func TestAdaptiveRefreshBufferingAdjustsToTheUpstreamLatency(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	capacity := 1000
+	numShards := 10
+	ttl := time.Hour
+	evictionPercentage := 10
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	refreshRetryInterval := time.Millisecond * 10
+	minBatchSize, maxBatchSize := 2, 10
+	minBufferTime, maxBufferTime := time.Second*10, time.Minute
+	targetLatency := time.Millisecond * 100
+	clock := sturdyc.NewTestClock(time.Now())
+	client := sturdyc.New(capacity, numShards, ttl, evictionPercentage,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, refreshRetryInterval, true),
+		sturdyc.WithAdaptiveRefreshBuffering(minBatchSize, maxBatchSize, minBufferTime, maxBufferTime, targetLatency),
+		sturdyc.WithClock(clock),
+	)
+
+	// The fetch function is going to move the clock forward to simulate latency.
+	var mu sync.Mutex
+	var latency time.Duration
+	fetchCompleted := make(chan struct{}, 1)
+	fetchFn := func(_ context.Context, ids []string) (map[string]string, error) {
+		defer func() { fetchCompleted <- struct{}{} }()
+		mu.Lock()
+		delay := latency
+		mu.Unlock()
+		if delay > 0 {
+			clock.Add(delay)
+		}
+		response := make(map[string]string, len(ids))
+		for _, id := range ids {
+			response[id] = "value" + id
+		}
+		return response, nil
+	}
+
+	ids := make([]string, 0, 20)
+	for i := 1; i <= 20; i++ {
+		ids = append(ids, strconv.Itoa(i))
+	}
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), fetchFn)
+	<-fetchCompleted
+	clock.Add(maxRefreshDelay + time.Second)
+
+	// The buffer starts out in the middle of the bounds, which gives us a batch
+	// size of 6. Requesting 6 IDs should therefore result in an immediate refresh.
+	sturdyc.GetFetchBatch(ctx, client, ids[:6], client.BatchKeyFn("item"), fetchFn)
+	<-fetchCompleted
+
+	// The upstream responded instantly, so the batch size should have grown.
+	sturdyc.GetFetchBatch(ctx, client, ids[6:7], client.BatchKeyFn("item"), fetchFn)
+	time.Sleep(10 * time.Millisecond)
+	buffers := client.RefreshBuffers()
+	if len(buffers) != 1 || buffers[0].BatchSize != 7 {
+		t.Fatalf("expected a buffer with a batch size of 7, got %v", buffers)
+	}
+
+	// Next, we'll make the upstream slow and flush the buffer.
+	mu.Lock()
+	latency = time.Second
+	mu.Unlock()
+	if err := client.FlushRefreshBuffers(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	<-fetchCompleted
+
+	// The latency exceeded the target, which should have cut the batch size in half.
+	sturdyc.GetFetchBatch(ctx, client, ids[7:8], client.BatchKeyFn("item"), fetchFn)
+	time.Sleep(10 * time.Millisecond)
+	buffers = client.RefreshBuffers()
+	if len(buffers) != 1 || buffers[0].BatchSize != 3 {
+		t.Fatalf("expected a buffer with a batch size of 3, got %v", buffers)
+	}
+}
+
+func TestGetFetchBatchByIDMergesTheRefreshesOfSeveralCalls(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	minRefreshDelay := time.Minute * 5
+	maxRefreshDelay := time.Minute * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	c := sturdyc.New(1000, 10, time.Hour, 5,
+		sturdyc.WithStampedeProtection(minRefreshDelay, maxRefreshDelay, time.Millisecond*10, true),
+		sturdyc.WithRefreshBuffering(4, time.Minute),
+		sturdyc.WithClock(clock),
+	)
+
+	idFn := func(id int64) string { return strconv.FormatInt(id, 10) }
+	keyFn := c.BatchKeyFn("item")
+	fetches := make(chan []int64, 10)
+	fetchFn := func(_ context.Context, ids []int64) (map[int64]string, error) {
+		fetches <- slices.Clone(ids)
+		response := make(map[int64]string, len(ids))
+		for _, id := range ids {
+			response[id] = "value" + strconv.FormatInt(id, 10)
+		}
+		return response, nil
+	}
+
+	records, err := sturdyc.GetFetchBatchByID(ctx, c, []int64{1, 2, 3, 4}, idFn, keyFn, fetchFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[3] != "value3" {
+		t.Fatalf("expected the records to be keyed by their IDs, got %v", records)
+	}
+	<-fetches
+
+	// The refreshes of the two calls are going to be buffered together, and
+	// fetched by the fetchFn of the first one, which has to be able to resolve
+	// the IDs of the second one.
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetchBatchByID(ctx, c, []int64{1, 2}, idFn, keyFn, fetchFn)
+	sturdyc.GetFetchBatchByID(ctx, c, []int64{3, 4}, idFn, keyFn, fetchFn)
+
+	select {
+	case ids := <-fetches:
+		slices.Sort(ids)
+		if !slices.Equal(ids, []int64{1, 2, 3, 4}) {
+			t.Errorf("expected the IDs of both calls to be refreshed together, got %v", ids)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the buffered IDs to be refreshed")
+	}
+}
+
+func TestGetFetchBatchByIDComputesEachKeyOnce(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	c := sturdyc.New(1000, 10, time.Hour, 5)
+
+	var keyCalls atomic.Int32
+	keyFn := sturdyc.KeyFn(func(id string) string {
+		keyCalls.Add(1)
+		return "item-" + id
+	})
+	idFn := func(id int64) string { return strconv.FormatInt(id, 10) }
+	fetchFn := func(_ context.Context, ids []int64) (map[int64]string, error) {
+		response := make(map[int64]string, len(ids))
+		for _, id := range ids {
+			response[id] = "value" + strconv.FormatInt(id, 10)
+		}
+		return response, nil
+	}
+
+	ids := []int64{1, 2, 3}
+	for _, call := range []string{"fetch", "cache hit"} {
+		keyCalls.Store(0)
+		records, err := sturdyc.GetFetchBatchByID(ctx, c, ids, idFn, keyFn, fetchFn)
+		if err != nil || len(records) != len(ids) {
+			t.Fatalf("expected %d records, got %v (err: %v)", len(ids), records, err)
+		}
+		if calls := keyCalls.Load(); calls != int32(len(ids)) {
+			t.Errorf("expected the %s to compute %d keys, got %d", call, len(ids), calls)
+		}
+	}
+}
+
+func TestExtendedMetricsAreLabeledByPrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	maxRefreshDelay := time.Minute * 10
+	clock := sturdyc.NewTestClock(time.Now())
+	metricsRecorder := newTestMetricsRecorder(10)
+	client := sturdyc.New(1000, 10, time.Hour, 10,
+		sturdyc.WithStampedeProtection(time.Minute*5, maxRefreshDelay, time.Millisecond*10, true),
+		sturdyc.WithRefreshBuffering(10, time.Minute),
+		sturdyc.WithClock(clock),
+		sturdyc.WithMetrics(metricsRecorder),
+		sturdyc.WithMetricsLabeler(func(key string) string {
+			prefix, _, _ := strings.Cut(key, "-")
+			return prefix
+		}),
+	)
+
+	var mu sync.Mutex
+	var batchFetches int
+	batchFetchFn := func(_ context.Context, ids []string) (map[string]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		batchFetches++
+		if batchFetches > 1 {
+			return nil, errors.New("upstream unavailable")
+		}
+		clock.Add(time.Millisecond * 30)
+		// The last ID is missing, and stored as such.
+		response := make(map[string]string, len(ids))
+		for _, id := range ids[:len(ids)-1] {
+			response[id] = "value"
+		}
+		return response, nil
+	}
+	fetchFn := func(_ context.Context) (string, error) {
+		return "", sturdyc.ErrStoreMissingRecord
+	}
+
+	ids := []string{"1", "2", "3"}
+	sturdyc.GetFetchBatch(ctx, client, ids, client.BatchKeyFn("item"), batchFetchFn)
+	sturdyc.GetFetch(ctx, client, "user-1", fetchFn)
+
+	// The refresh is buffered until we flush it, which is going to make it fail.
+	clock.Add(maxRefreshDelay + time.Second)
+	sturdyc.GetFetchBatch(ctx, client, ids[:2], client.BatchKeyFn("item"), batchFetchFn)
+	time.Sleep(10 * time.Millisecond)
+	if err := client.FlushRefreshBuffers(ctx); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	metricsRecorder.Lock()
+	defer metricsRecorder.Unlock()
+	wantFetchDurations := map[string][]time.Duration{"item": {time.Millisecond * 30}, "user": {0}}
+	if diff := cmp.Diff(wantFetchDurations, metricsRecorder.fetchDurations); diff != "" {
+		t.Errorf("unexpected fetch durations (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]int{"item": 1, "user": 1}, metricsRecorder.missingRecords); diff != "" {
+		t.Errorf("unexpected missing records (-want +got):\n%s", diff)
+	}
+	wantOutcomes := map[string][]sturdyc.RefreshOutcome{"item": {sturdyc.RefreshFailed}}
+	if diff := cmp.Diff(wantOutcomes, metricsRecorder.refreshOutcomes); diff != "" {
+		t.Errorf("unexpected refresh outcomes (-want +got):\n%s", diff)
+	}
+	wantFlushes := map[string][]sturdyc.BufferFlushReason{"item": {sturdyc.BufferFlushManual}}
+	if diff := cmp.Diff(wantFlushes, metricsRecorder.labeledFlushes); diff != "" {
+		t.Errorf("unexpected buffer flushes (-want +got):\n%s", diff)
+	}
+}
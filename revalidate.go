@@ -0,0 +1,131 @@
+package sturdyc
+
+import (
+	"context"
+	"errors"
+)
+
+// RevalidateFn is a fetch function that gets access to the value that is
+// currently cached, along with its validator. The validator is an opaque
+// value, such as an ETag or a version number, that was returned by the
+// previous call. When the record hasn't been cached before, the value is
+// the zero value of T, and the validator is an empty string.
+//
+// Returning ErrNotModified tells the cache that the cached value is still
+// valid, which extends the lifetime of the entry without replacing it.
+type RevalidateFn[T any] func(ctx context.Context, cached T, validator string) (T, string, error)
+
+// GetFetchRevalidate works like GetFetch, except that the refreshes are
+// performed as conditional requests using the cached value and validator.
+// Like GetFetch, concurrent calls for a key that is being fetched are going
+// to wait for, and share, the response of the fetch that is already in flight.
+func GetFetchRevalidate[T any](ctx context.Context, client *Client, key string, fetchFn RevalidateFn[T]) (T, error) {
+	value, ok, shouldIgnore, shouldRefresh := get[T](client, key)
+
+	if shouldRefresh {
+		safeGo(func() {
+			revalidate(client, key, fetchFn)
+		})
+	}
+
+	if shouldIgnore {
+		return value, ErrMissingRecord
+	}
+
+	if ok {
+		return value, nil
+	}
+
+	value, _, err := fetchOnce(ctx, client, key, func() (T, error) {
+		return revalidateAndSet(ctx, client, key, fetchFn)
+	})
+	return value, err
+}
+
+// revalidateAndSet fetches the value of a key that wasn't cached, and writes
+// the response to the cache along with its validator.
+func revalidateAndSet[T any](ctx context.Context, client *Client, key string, fetchFn RevalidateFn[T]) (T, error) {
+	var zero T
+	token, release := client.writeToken(key)
+	defer release()
+	start := client.clock.Now()
+	response, validator, err := fetchFn(ctx, zero, "")
+	fetchDuration := client.clock.Now().Sub(start)
+	client.reportFetch(key, fetchDuration)
+	if err != nil {
+		if client.storeMisses && errors.Is(err, ErrStoreMissingRecord) {
+			client.set(key, write{
+				value:           response,
+				isMissingRecord: true,
+				fetchDuration:   fetchDuration,
+				refresher:       revalidateRefresher(client, key, fetchFn),
+				validator:       validator,
+				token:           token,
+			})
+		}
+		return response, err
+	}
+
+	client.set(key, write{
+		value:           response,
+		isMissingRecord: false,
+		fetchDuration:   fetchDuration,
+		refresher:       revalidateRefresher(client, key, fetchFn),
+		validator:       validator,
+		token:           token,
+	})
+	return response, nil
+}
+
+func revalidate[T any](client *Client, key string, fetchFn RevalidateFn[T]) {
+	token, release := client.writeToken(key)
+	defer release()
+	shard := client.getShard(key)
+	var cached T
+	cachedValue, validator, ok := shard.validated(key)
+	if ok {
+		cached, _ = cachedValue.(T)
+	}
+
+	start := client.clock.Now()
+	response, newValidator, err := fetchFn(context.Background(), cached, validator)
+	fetchDuration := client.clock.Now().Sub(start)
+	client.reportRefresh(key, fetchDuration, err)
+	if ok && errors.Is(err, ErrNotModified) {
+		shard.revalidated(key, fetchDuration, token)
+		return
+	}
+
+	if err != nil {
+		if client.storeMisses && errors.Is(err, ErrStoreMissingRecord) {
+			client.setRefreshed(key, write{
+				value:           response,
+				isMissingRecord: true,
+				fetchDuration:   fetchDuration,
+				refresher:       revalidateRefresher(client, key, fetchFn),
+				validator:       newValidator,
+				token:           token,
+			})
+		}
+		return
+	}
+
+	client.setRefreshed(key, write{
+		value:           response,
+		isMissingRecord: false,
+		fetchDuration:   fetchDuration,
+		refresher:       revalidateRefresher(client, key, fetchFn),
+		validator:       newValidator,
+		token:           token,
+	})
+}
+
+// revalidateRefresher returns a function that revalidates the key, or nil if proactive refreshes are disabled.
+func revalidateRefresher[T any](c *Client, key string, fetchFn RevalidateFn[T]) func() {
+	if c.proactiveRefreshTopK < 1 {
+		return nil
+	}
+	return func() {
+		revalidate(c, key, fetchFn)
+	}
+}
@@ -3,6 +3,7 @@ package sturdyc
 import (
 	"math"
 	"math/rand/v2"
+	"sort"
 	"sync"
 	"time"
 )
@@ -20,6 +21,29 @@ type shard struct {
 	minRefreshTime   time.Duration
 	maxRefreshTime   time.Duration
 	retryBaseDelay   time.Duration
+	refreshStrategy  refreshStrategy
+	xfetchBeta       float64
+
+	minAccesses  int64
+	accessWindow time.Duration
+	// trackAccesses is set when the reads have to be counted, which
+	// is only the case if they affect which entries are refreshed.
+	trackAccesses bool
+
+	maxRefreshInterval time.Duration
+	equalFn            func(a, b any) bool
+
+	evictionHook func(key string, value any, reason EvictionReason)
+
+	// tokens issues a version for every write and delete of the shard.
+	tokens *writeTokens
+	// deletes holds the version that each key was deleted at. Writes for keys
+	// that don't exist are dropped if the key was deleted after their token was
+	// issued. The versions are pruned once no token is older than them.
+	deletes map[string]uint64
+
+	stats          *stats
+	metricsLabeler func(key string) string
 }
 
 func newShard(
@@ -32,6 +56,16 @@ func newShard(
 	minRefreshTime,
 	maxRefreshTime time.Duration,
 	retryBaseDelay time.Duration,
+	refreshStrategy refreshStrategy,
+	xfetchBeta float64,
+	minAccesses int64,
+	accessWindow time.Duration,
+	trackAccesses bool,
+	maxRefreshInterval time.Duration,
+	equalFn func(a, b any) bool,
+	evictionHook func(key string, value any, reason EvictionReason),
+	stats *stats,
+	metricsLabeler func(key string) string,
 ) *shard {
 	return &shard{
 		capacity:           capacity,
@@ -45,6 +79,18 @@ func newShard(
 		maxRefreshTime:     maxRefreshTime,
 		refreshesEnabled:   refreshesEnabled,
 		retryBaseDelay:     retryBaseDelay,
+		refreshStrategy:    refreshStrategy,
+		xfetchBeta:         xfetchBeta,
+		minAccesses:        minAccesses,
+		accessWindow:       accessWindow,
+		trackAccesses:      trackAccesses,
+		maxRefreshInterval: maxRefreshInterval,
+		equalFn:            equalFn,
+		evictionHook:       evictionHook,
+		tokens:             newWriteTokens(),
+		stats:              stats,
+		metricsLabeler:     metricsLabeler,
+		deletes:            make(map[string]uint64),
 	}
 }
 
@@ -63,17 +109,32 @@ func (s *shard) evictExpired() {
 	for _, e := range s.entries {
 		if s.clock.Now().After(e.expiresAt) {
 			delete(s.entries, e.key)
+			s.evicted(e, EvictionExpired)
 			entriesEvicted++
 		}
 	}
-	if s.metricsRecorder != nil && entriesEvicted > 0 {
-		s.metricsRecorder.EntriesEvicted(entriesEvicted)
+	s.reportEvictions(entriesEvicted)
+	s.pruneDeletes()
+}
+
+// pruneDeletes removes the versions of the deletes that no fetch or refresh
+// that is in flight could be older than. NOTE: Should be called with a lock.
+func (s *shard) pruneDeletes() {
+	if len(s.deletes) == 0 {
+		return
+	}
+	oldest := s.tokens.oldest()
+	for key, version := range s.deletes {
+		if version <= oldest {
+			delete(s.deletes, key)
+		}
 	}
 }
 
 // forceEvict evicts a certain percentage of the entries in the shard
 // based on the expiration time. NOTE: Should be called with a lock.
 func (s *shard) forceEvict() {
+	s.stats.forcedEvictions.Add(1)
 	if s.metricsRecorder != nil {
 		s.metricsRecorder.ForcedEviction()
 	}
@@ -88,51 +149,315 @@ func (s *shard) forceEvict() {
 	for key, e := range s.entries {
 		if e.expiresAt.Before(cutoff) {
 			delete(s.entries, key)
+			s.evicted(e, EvictionCapacity)
 			entriesEvicted++
 		}
 	}
-	if s.metricsRecorder != nil && entriesEvicted > 0 {
-		s.metricsRecorder.EntriesEvicted(entriesEvicted)
-	}
+	s.reportEvictions(entriesEvicted)
 }
 
-func (s *shard) get(key string) (val any, exists, ignore, refresh bool) {
+// getWithInfo returns the value of the key, and whether it should be ignored
+// or refreshed. The info is populated with the metadata of the entry unless
+// it's nil.
+func (s *shard) getWithInfo(key string, info *EntryInfo) (val any, exists, ignore, refresh bool) {
 	s.mu.RLock()
-	if item, ok := s.entries[key]; ok {
-		if s.clock.Now().After(item.expiresAt) {
-			s.mu.RUnlock()
-			return nil, false, false, false
-		}
+	now := s.clock.Now()
+	item, ok := s.entries[key]
+	if !ok || now.After(item.expiresAt) {
+		s.mu.RUnlock()
+		return nil, false, false, false
+	}
 
-		shouldRefresh := s.refreshesEnabled && s.clock.Now().After(item.refreshAt)
+	var accesses int64
+	if s.trackAccesses {
+		accesses = item.recordAccess(now, s.accessWindow)
+	}
+	shouldRefresh := s.refreshesEnabled && accesses >= s.minAccesses && s.shouldRefresh(item, now)
+	if !shouldRefresh {
+		s.populateInfo(info, item)
 		s.mu.RUnlock()
-		if shouldRefresh {
-			// During the time it takes to switch to a write lock, another goroutine
-			// might have acquired it and moved the refreshAt before we could.
-			s.mu.Lock()
-			shoulStillRefresh := s.clock.Now().After(item.refreshAt)
-			if !shoulStillRefresh {
-				s.mu.Unlock()
-				return item.value, true, item.isMissingRecord, false
-			}
-
-			// Update the "refreshAt" so no other goroutines attempts to refresh the same entry.
-			nextRefresh := math.Pow(2, float64(item.numOfRefreshRetries)) * float64(s.retryBaseDelay)
-			item.refreshAt = s.clock.Now().Add(time.Duration(nextRefresh))
-			item.numOfRefreshRetries++
-			s.mu.Unlock()
-		}
-		return item.value, true, item.isMissingRecord, shouldRefresh
+		return item.value, true, item.isMissingRecord, false
 	}
 	s.mu.RUnlock()
-	return nil, false, false, false
+
+	// During the time it takes to switch to a write lock, another goroutine
+	// might have acquired it and moved the refreshAt before we could.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shoulStillRefresh := s.clock.Now().After(item.refreshAt)
+	if shoulStillRefresh {
+		s.scheduleRefresh(item)
+	}
+	s.populateInfo(info, item)
+	return item.value, true, item.isMissingRecord, shoulStillRefresh
+}
+
+// peek retrieves an entry without recording the access or scheduling a refresh.
+func (s *shard) peek(key string) (any, EntryInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var info EntryInfo
+	item, ok := s.entries[key]
+	if !ok || s.clock.Now().After(item.expiresAt) {
+		return nil, info, false
+	}
+	s.populateInfo(&info, item)
+	return item.value, info, true
+}
+
+// populateInfo describes the entry unless the info is nil. NOTE: Should be called with a lock.
+func (s *shard) populateInfo(info *EntryInfo, e *entry) {
+	if info == nil {
+		return
+	}
+
+	now := s.clock.Now()
+	var lastAccess time.Time
+	if nanos := e.lastAccess.Load(); nanos > 0 {
+		lastAccess = time.Unix(0, nanos)
+	}
+	*info = EntryInfo{
+		Age:             now.Sub(e.writtenAt),
+		ExpiresAt:       e.expiresAt,
+		RefreshAt:       e.refreshAt,
+		RefreshRetries:  e.numOfRefreshRetries,
+		IsMissingRecord: e.isMissingRecord,
+		Accesses:        e.accessesWithinWindow(now, s.accessWindow),
+		LastAccess:      lastAccess,
+		FetchDuration:   e.fetchDuration,
+	}
+}
+
+// scheduleRefresh updates the "refreshAt" so no other goroutines attempts to
+// refresh the same entry. NOTE: Should be called with a lock.
+func (s *shard) scheduleRefresh(e *entry) {
+	nextRefresh := math.Pow(2, float64(e.numOfRefreshRetries)) * float64(s.retryBaseDelay)
+	e.refreshAt = s.clock.Now().Add(time.Duration(nextRefresh))
+	e.numOfRefreshRetries++
+}
+
+// shouldRefresh determines if it's time to refresh the entry. NOTE: Should be called with a lock.
+func (s *shard) shouldRefresh(e *entry, now time.Time) bool {
+	if !now.After(e.refreshAt) {
+		return false
+	}
+
+	if s.refreshStrategy != refreshStrategyXFetch || now.After(e.refreshDeadline) {
+		return true
+	}
+
+	// XFetch: the closer we get to the deadline, and the longer it took to fetch
+	// the value, the more likely it becomes that this read triggers a refresh.
+	// Subtracting from one gives us a number in (0, 1] which keeps us clear of ln(0).
+	gap := float64(e.fetchDuration) * s.xfetchBeta * -math.Log(1-rand.Float64())
+	return !now.Add(time.Duration(gap)).Before(e.refreshDeadline)
 }
 
 // set sets a key-value pair in the shard. Returns true if it triggered an eviction.
-func (s *shard) set(key string, value any, isMissingRecord bool) bool {
+func (s *shard) set(key string, w write) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if s.isStale(key, w.token) {
+		return false
+	}
+	return s.store(key, w, 0)
+}
+
+// delete removes the key from the shard, and prevents in-flight fetches from writing it back.
+func (s *shard) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.remove(key) {
+		s.reportEvictions(1)
+	}
+}
 
+// remove deletes the key, and records the version of the delete. Returns
+// true if the key existed. NOTE: Should be called with a lock.
+func (s *shard) remove(key string) bool {
+	s.deletes[key] = s.tokens.next()
+	e, ok := s.entries[key]
+	if !ok {
+		return false
+	}
+	delete(s.entries, key)
+	s.evicted(e, EvictionDeleted)
+	return true
+}
+
+// evicted calls the eviction hook for an entry that has been removed. NOTE: Should be called with a lock.
+func (s *shard) evicted(e *entry, reason EvictionReason) {
+	if s.evictionHook != nil {
+		s.evictionHook(e.key, e.value, reason)
+	}
+}
+
+// compute performs the action returned by fn while holding the lock. Returns
+// the value of the key once the action has been performed, and whether it exists.
+func (s *shard) compute(key string, fn func(old any, exists, isMissingRecord bool) (any, ComputeAction)) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var old any
+	var isMissingRecord bool
+	e, exists := s.entries[key]
+	if exists && s.clock.Now().After(e.expiresAt) {
+		exists = false
+	}
+	if exists {
+		old = e.value
+		isMissingRecord = e.isMissingRecord
+	}
+
+	value, action := fn(old, exists, isMissingRecord)
+	switch action {
+	case ComputeStore:
+		s.store(key, write{
+			value:           value,
+			isMissingRecord: false,
+			fetchDuration:   0,
+			refresher:       nil,
+			validator:       "",
+			token:           unconditionalWrite,
+		}, 0)
+		// The store is a no-op if the shard is configured to not evict any entries.
+		if current, ok := s.entries[key]; !ok || current == e {
+			return old, exists
+		}
+		return value, true
+	case ComputeDelete:
+		if s.remove(key) {
+			s.reportEvictions(1)
+		}
+		return nil, false
+	case ComputeKeep:
+	}
+	return old, exists
+}
+
+// isStale reports whether the key has been written, or deleted, after the
+// token was issued. Stale writes are dropped and reported to the metrics
+// recorder, unless the key was written by another fetch or refresh that was
+// in flight at the same time, e.g. when two fetches of a missing key race.
+// NOTE: Should be called with a lock.
+func (s *shard) isStale(key string, token uint64) bool {
+	var stale, raced bool
+	if e, ok := s.entries[key]; ok {
+		stale = e.version > token
+		raced = e.fetched
+	} else if version, ok := s.deletes[key]; ok {
+		stale = version > token
+	}
+	if !stale {
+		return false
+	}
+	if raced {
+		return true
+	}
+	if recorder, ok := s.metricsRecorder.(DroppedWriteMetricsRecorder); ok {
+		recorder.StaleWriteDropped()
+	}
+	return true
+}
+
+// setRefreshed is used to write the value of a refresh. If change aware
+// refreshes are enabled, the value is compared to the one it replaces in
+// order to determine when the entry should be refreshed next. Returns true
+// if it triggered an eviction.
+func (s *shard) setRefreshed(key string, w write) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isStale(key, w.token) {
+		return false
+	}
+
+	var backoff int
+	if previous, ok := s.entries[key]; ok && s.maxRefreshInterval > 0 {
+		changed := previous.isMissingRecord != w.isMissingRecord
+		if !changed && !w.isMissingRecord {
+			changed = !valuesEqual(s.equalFn, previous.value, w.value)
+		}
+		backoff = s.increaseRefreshBackoff(previous.refreshBackoff)
+		if changed {
+			backoff = max(previous.refreshBackoff-1, 0)
+		}
+		if recorder, ok := s.metricsRecorder.(RefreshChangeMetricsRecorder); ok {
+			recorder.RefreshedValue(changed)
+		}
+	}
+	return s.store(key, w, backoff)
+}
+
+// revalidated extends the lifetime of an entry whose value was confirmed to be
+// up to date by a RevalidateFn. Returns false if the entry no longer exists,
+// or if it has been replaced since the token was issued.
+func (s *shard) revalidated(key string, fetchDuration time.Duration, token uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, ok := s.entries[key]
+	if !ok || s.isStale(key, token) {
+		return false
+	}
+
+	var backoff int
+	if s.maxRefreshInterval > 0 {
+		backoff = s.increaseRefreshBackoff(previous.refreshBackoff)
+		if recorder, ok := s.metricsRecorder.(RefreshChangeMetricsRecorder); ok {
+			recorder.RefreshedValue(false)
+		}
+	}
+
+	s.store(key, write{
+		value:           previous.value,
+		isMissingRecord: previous.isMissingRecord,
+		fetchDuration:   fetchDuration,
+		refresher:       previous.refresher,
+		validator:       previous.validator,
+		token:           token,
+	}, backoff)
+	return true
+}
+
+// validated returns the value and validator of an entry that hasn't expired.
+func (s *shard) validated(key string) (value any, validator string, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	e, ok := s.entries[key]
+	if !ok || s.clock.Now().After(e.expiresAt) {
+		return nil, "", false
+	}
+	return e.value, e.validator, true
+}
+
+// increaseRefreshBackoff adds a step to the backoff, unless the refresh
+// interval has already reached the max refresh interval. Growing the backoff
+// past that point would leave the interval at the max for a while after the
+// value starts to change again.
+func (s *shard) increaseRefreshBackoff(backoff int) int {
+	if s.minRefreshTime <= 0 {
+		return 0
+	}
+	ratio := float64(s.maxRefreshInterval) / float64(s.minRefreshTime)
+	maxBackoff := max(int(math.Ceil(math.Log2(ratio))), 0)
+	return min(backoff+1, maxBackoff)
+}
+
+// scaleRefreshInterval doubles the interval for every step of the backoff,
+// without exceeding the max refresh interval.
+func (s *shard) scaleRefreshInterval(interval time.Duration, backoff int) time.Duration {
+	if backoff < 1 || s.maxRefreshInterval <= 0 {
+		return interval
+	}
+	scaled := math.Pow(2, float64(backoff)) * float64(interval)
+	return time.Duration(min(scaled, float64(s.maxRefreshInterval)))
+}
+
+// store writes the entry to the shard. Returns true if it triggered an
+// eviction. NOTE: Should be called with a lock.
+func (s *shard) store(key string, w write, refreshBackoff int) bool {
 	now := s.clock.Now()
 
 	// Check we need to perform an eviction first.
@@ -147,21 +472,90 @@ func (s *shard) set(key string, value any, isMissingRecord bool) bool {
 		s.forceEvict()
 	}
 
+	if w.isMissingRecord {
+		s.reportMissingRecordStored(key)
+	}
+
 	//nolint: exhaustruct // we are going to set the remaining fields based on config.
 	e := &entry{
 		key:             key,
-		value:           value,
+		value:           w.value,
+		writtenAt:       now,
 		expiresAt:       now.Add(s.ttl),
-		isMissingRecord: isMissingRecord,
+		fetchDuration:   w.fetchDuration,
+		isMissingRecord: w.isMissingRecord,
+		refresher:       w.refresher,
+		validator:       w.validator,
+		refreshBackoff:  refreshBackoff,
+		version:         s.tokens.next(),
+		fetched:         w.token != unconditionalWrite,
+	}
+	e.accessWindowStart.Store(now.UnixNano())
+	if previous, ok := s.entries[key]; ok {
+		e.inheritAccesses(previous)
 	}
 
-	if s.refreshesEnabled {
+	if s.refreshesEnabled && s.refreshStrategy == refreshStrategyXFetch {
+		// With XFetch, the entry becomes eligible for a refresh after the min
+		// refresh time, and is refreshed no later than the max refresh time.
+		e.refreshAt = now.Add(s.scaleRefreshInterval(s.minRefreshTime, refreshBackoff))
+		e.refreshDeadline = now.Add(s.scaleRefreshInterval(s.maxRefreshTime, refreshBackoff))
+		e.numOfRefreshRetries = 0
+	} else if s.refreshesEnabled {
 		// Add a random padding to the refresh times in order to spread them out more evenly.
 		padding := time.Duration(rand.Int64N(int64(s.maxRefreshTime - s.minRefreshTime)))
-		e.refreshAt = now.Add(s.minRefreshTime + padding)
+		e.refreshAt = now.Add(s.scaleRefreshInterval(s.minRefreshTime+padding, refreshBackoff))
 		e.numOfRefreshRetries = 0
 	}
 	s.entries[key] = e
+	delete(s.deletes, key)
 
 	return evict
 }
+
+// hotEntry is an entry that is about to become due for a refresh, along with
+// the shard that it belongs to and the number of times it has been accessed.
+type hotEntry struct {
+	shard    *shard
+	entry    *entry
+	accesses int64
+}
+
+// hotEntries returns up to n of the most accessed entries that can be refreshed
+// proactively, and that are due for a refresh before the given horizon.
+func (s *shard) hotEntries(n int, horizon time.Time) []hotEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	now := s.clock.Now()
+	candidates := make([]hotEntry, 0)
+	for _, e := range s.entries {
+		if e.refresher == nil || now.After(e.expiresAt) || e.refreshAt.After(horizon) {
+			continue
+		}
+		accesses := e.accessesWithinWindow(now, s.accessWindow)
+		if accesses < max(s.minAccesses, 1) {
+			continue
+		}
+		candidates = append(candidates, hotEntry{shard: s, entry: e, accesses: accesses})
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].accesses > candidates[j].accesses
+	})
+	return candidates[:min(n, len(candidates))]
+}
+
+// claimRefresh reports whether the caller should refresh the entry. It returns
+// false if the entry has been replaced, or if its refresh has been claimed by
+// another goroutine.
+func (s *shard) claimRefresh(e *entry, horizon time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if current, ok := s.entries[e.key]; !ok || current != e || e.refreshAt.After(horizon) {
+		return false
+	}
+	s.scheduleRefresh(e)
+	return true
+}
@@ -0,0 +1,84 @@
+package sturdyc
+
+import "sync/atomic"
+
+// Stats is a snapshot of the counters that the client keeps, regardless of
+// whether it's been configured with a MetricsRecorder. The counters are read
+// one at a time, which means that they can be slightly out of sync with each
+// other if the cache is in use while the snapshot is taken.
+type Stats struct {
+	// Hits and Misses are the number of lookups that found, and didn't find, a value in the cache.
+	Hits   uint64
+	Misses uint64
+	// Evictions is the number of entries that have been removed, because they
+	// expired, to make room for other entries, or because they were deleted.
+	Evictions uint64
+	// ForcedEvictions is the number of times that a shard reached its capacity.
+	ForcedEvictions uint64
+	// Refreshes is the number of background refreshes that have been performed,
+	// and RefreshErrors the number of them that failed. Records that turned out
+	// to be missing aren't counted as errors.
+	Refreshes     uint64
+	RefreshErrors uint64
+	// CoalescedFetches is the number of calls that shared the result of a fetch that was already in flight.
+	CoalescedFetches uint64
+	// BufferedBatches is the number of refresh buffers that have been flushed.
+	BufferedBatches uint64
+	// ShardSizes holds the number of entries in each shard.
+	ShardSizes []int
+}
+
+// stats holds the counters of the client. The shards share them through a pointer.
+type stats struct {
+	hits             atomic.Uint64
+	misses           atomic.Uint64
+	evictions        atomic.Uint64
+	forcedEvictions  atomic.Uint64
+	refreshes        atomic.Uint64
+	refreshErrors    atomic.Uint64
+	coalescedFetches atomic.Uint64
+	bufferedBatches  atomic.Uint64
+}
+
+// Stats returns a snapshot of the counters, and the current size of each shard.
+func (c *Client) Stats() Stats {
+	shardSizes := make([]int, 0, len(c.shards))
+	for _, shard := range c.shards {
+		shardSizes = append(shardSizes, shard.size())
+	}
+
+	return Stats{
+		Hits:             c.stats.hits.Load(),
+		Misses:           c.stats.misses.Load(),
+		Evictions:        c.stats.evictions.Load(),
+		ForcedEvictions:  c.stats.forcedEvictions.Load(),
+		Refreshes:        c.stats.refreshes.Load(),
+		RefreshErrors:    c.stats.refreshErrors.Load(),
+		CoalescedFetches: c.stats.coalescedFetches.Load(),
+		BufferedBatches:  c.stats.bufferedBatches.Load(),
+		ShardSizes:       shardSizes,
+	}
+}
+
+// ResetStats sets every counter back to zero. The sizes of the shards are unaffected.
+func (c *Client) ResetStats() {
+	c.stats.hits.Store(0)
+	c.stats.misses.Store(0)
+	c.stats.evictions.Store(0)
+	c.stats.forcedEvictions.Store(0)
+	c.stats.refreshes.Store(0)
+	c.stats.refreshErrors.Store(0)
+	c.stats.coalescedFetches.Store(0)
+	c.stats.bufferedBatches.Store(0)
+}
+
+// reportEvictions counts the entries that were removed from the shard. NOTE: Should be called with a lock.
+func (s *shard) reportEvictions(entriesEvicted int) {
+	if entriesEvicted < 1 {
+		return
+	}
+	s.stats.evictions.Add(uint64(entriesEvicted))
+	if s.metricsRecorder != nil {
+		s.metricsRecorder.EntriesEvicted(entriesEvicted)
+	}
+}
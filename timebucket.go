@@ -0,0 +1,81 @@
+package sturdyc
+
+import "time"
+
+// TimeBucket returns the start of the bucket that the time belongs to. Time
+// fields are written to the keys by the bucket that they belong to, which
+// makes every time within the same bucket produce the same key.
+type TimeBucket func(t time.Time) time.Time
+
+// TruncateBucket returns buckets of a fixed duration, which are aligned to
+// the zero time. It's the bucket that WithRelativeTimeKeyFormat uses.
+func TruncateBucket(d time.Duration) TimeBucket {
+	return func(t time.Time) time.Time {
+		return t.Truncate(d)
+	}
+}
+
+// DayBucket returns buckets that start at midnight in the location. The days
+// that daylight saving time begins or ends are shorter or longer than 24h.
+func DayBucket(loc *time.Location) TimeBucket {
+	return func(t time.Time) time.Time {
+		return startOfDay(t, loc)
+	}
+}
+
+// ISOWeekBucket returns buckets that start at midnight on Mondays in the location.
+func ISOWeekBucket(loc *time.Location) TimeBucket {
+	return func(t time.Time) time.Time {
+		day := startOfDay(t, loc)
+		daysSinceMonday := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -daysSinceMonday)
+	}
+}
+
+// BusinessHoursBucket returns a bucket for the business hours of each weekday,
+// and one for the hours in between. The opens and closes offsets are the wall
+// clock times, in the location, that the business hours begin and end. The
+// time from the close on Friday to the open on Monday is a single bucket.
+func BusinessHoursBucket(loc *time.Location, opens, closes time.Duration) TimeBucket {
+	if opens < 0 || closes <= opens || closes > 24*time.Hour {
+		panic("opens must be before closes, and both have to be within the day")
+	}
+
+	return func(t time.Time) time.Time {
+		day := startOfDay(t, loc)
+		if isWeekday(day) {
+			opensAt, closesAt := wallClock(day, opens), wallClock(day, closes)
+			if !t.Before(opensAt) && t.Before(closesAt) {
+				return opensAt
+			}
+			if !t.Before(closesAt) {
+				return closesAt
+			}
+		}
+
+		// The time is outside of the business hours, which means that the
+		// bucket started when the previous business day closed.
+		for {
+			day = day.AddDate(0, 0, -1)
+			if isWeekday(day) {
+				return wallClock(day, closes)
+			}
+		}
+	}
+}
+
+func startOfDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, loc)
+}
+
+// wallClock returns the time of the day when a clock on the wall shows the
+// offset, which isn't the same as adding it on days with daylight saving changes.
+func wallClock(day time.Time, offset time.Duration) time.Time {
+	year, month, d := day.Date()
+	return time.Date(year, month, d, 0, 0, 0, int(offset), day.Location())
+}
+
+func isWeekday(day time.Time) bool {
+	return day.Weekday() != time.Saturday && day.Weekday() != time.Sunday
+}
@@ -0,0 +1,87 @@
+package sturdyc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// writeTokens issues the versions of the writes and deletes of a shard, and
+// keeps track of the tokens that fetches and refreshes are holding while
+// they're in flight. Each shard has its own, which keeps writes to different
+// shards from contending with each other.
+type writeTokens struct {
+	versions atomic.Uint64
+	mu       sync.Mutex
+	inFlight map[uint64]int
+}
+
+func newWriteTokens() *writeTokens {
+	//nolint: exhaustruct // The zero values of the version and mutex are ready to use.
+	return &writeTokens{inFlight: make(map[uint64]int)}
+}
+
+// next returns the version of a write or delete.
+func (w *writeTokens) next() uint64 {
+	return w.versions.Add(1)
+}
+
+// acquire returns the current version as a token, which is held until release is called.
+func (w *writeTokens) acquire() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	token := w.versions.Load()
+	w.inFlight[token]++
+	return token
+}
+
+func (w *writeTokens) release(token uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.inFlight[token]--
+	if w.inFlight[token] < 1 {
+		delete(w.inFlight, token)
+	}
+}
+
+// oldest returns the oldest token that is held by a fetch or refresh. If
+// there are none, it returns the current version, which no token that is
+// issued later can be older than.
+func (w *writeTokens) oldest() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	oldest := w.versions.Load()
+	for token := range w.inFlight {
+		oldest = min(oldest, token)
+	}
+	return oldest
+}
+
+// batchWriteTokens holds a write token from each of the shards that the keys
+// of a batch belong to.
+type batchWriteTokens map[*shard]uint64
+
+// batchWriteTokens captures a write token from each of the shards that the
+// keys of the IDs belong to. The tokens have to be released once the
+// response has been written.
+func (c *Client) batchWriteTokens(keys batchKeys, ids []string) (batchWriteTokens, func()) {
+	tokens := make(batchWriteTokens)
+	for _, id := range ids {
+		shard := c.shards[c.shardIndex(keys.key(id))]
+		if _, ok := tokens[shard]; !ok {
+			tokens[shard] = shard.tokens.acquire()
+		}
+	}
+	return tokens, func() {
+		for shard, token := range tokens {
+			shard.tokens.release(token)
+		}
+	}
+}
+
+// token returns the token of the shard that the key belongs to. Keys of IDs
+// that weren't part of the batch can belong to a shard without a token. They
+// get the oldest token possible, which means that they're only written if the
+// key isn't cached, and hasn't been deleted while a fetch was in flight.
+func (t batchWriteTokens) token(c *Client, key string) uint64 {
+	return t[c.shards[c.shardIndex(key)]]
+}